@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIMaxPlanSize is the maximum size of a plan submitted via the http api
+const APIMaxPlanSize = 64 << 20
+
+// apiInterface is a network interface of a client in the http api
+type apiInterface struct {
+	Name string
+	MAC  string
+	IPs  []string
+}
+
+// apiClient is a client connected to the server in the http api
+type apiClient struct {
+	ID         uint8
+	Address    string
+	Version    uint16
+	Software   string
+	Protocols  []uint16
+	Features   []string
+	Interfaces []*apiInterface
+}
+
+// newAPIClient creates a new api client from client handler c
+func newAPIClient(c *clientHandler) *apiClient {
+	a := &apiClient{
+		ID:         c.id,
+		Address:    c.conn.RemoteAddr().String(),
+		Version:    c.reg.Version,
+		Software:   c.reg.Software,
+		Protocols:  c.reg.Protocols,
+		Features:   c.reg.Features,
+		Interfaces: []*apiInterface{},
+	}
+	for _, i := range c.reg.Interfaces {
+		iface := &apiInterface{
+			Name: i.Name,
+			MAC:  i.MAC.String(),
+			IPs:  []string{},
+		}
+		for _, ip := range i.IPs {
+			iface.IPs = append(iface.IPs, ip.String())
+		}
+		a.Interfaces = append(a.Interfaces, iface)
+	}
+	return a
+}
+
+// apiRun is the status of a plan run in the http api
+type apiRun struct {
+	ID        int
+	State     string
+	Error     string `json:",omitempty"`
+	Clients   []int
+	Items     int
+	DoneItems int
+	Percent   float64
+	Started   *time.Time `json:",omitempty"`
+	Finished  *time.Time `json:",omitempty"`
+}
+
+// newAPIRun creates a new api run from plan run r
+func newAPIRun(r *planRun) *apiRun {
+	a := &apiRun{
+		ID:        r.id,
+		State:     r.state,
+		Items:     len(r.plan.items),
+		DoneItems: r.plan.getProgress(),
+	}
+	a.Percent = float64(a.DoneItems) / float64(a.Items) * 100
+	for _, id := range r.clients {
+		a.Clients = append(a.Clients, int(id))
+	}
+	if r.err != nil {
+		a.Error = r.err.Error()
+	}
+	if !r.started.IsZero() {
+		a.Started = &r.started
+	}
+	if !r.finished.IsZero() {
+		a.Finished = &r.finished
+	}
+	return a
+}
+
+// writeJSON writes v as json with status code to w
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	j, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(j)
+}
+
+// handleGetClients lists the connected clients
+func (s *server) handleGetClients(w http.ResponseWriter, r *http.Request) {
+	clients := []*apiClient{}
+	s.call(func() {
+		for _, id := range slices.Sorted(maps.Keys(s.clients)) {
+			clients = append(clients, newAPIClient(s.clients[id]))
+		}
+	})
+	writeJSON(w, http.StatusOK, clients)
+}
+
+// handleGetPlans lists all plan runs
+func (s *server) handleGetPlans(w http.ResponseWriter, r *http.Request) {
+	runs := []*apiRun{}
+	s.call(func() {
+		for _, run := range s.runs {
+			runs = append(runs, newAPIRun(run))
+		}
+	})
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handlePostPlan reads the plan items in the request and queues them
+func (s *server) handlePostPlan(w http.ResponseWriter, r *http.Request) {
+	j, err := io.ReadAll(http.MaxBytesReader(w, r.Body, APIMaxPlanSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := &plan{}
+	if err := json.Unmarshal(j, &p.items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.setClients(s.config.SenderID, s.config.ReceiverID)
+	p.schedule()
+
+	var run *apiRun
+	s.call(func() {
+		var queued *planRun
+		queued, err = s.queueRun(p)
+		if err == nil {
+			run = newAPIRun(queued)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, run)
+}
+
+// getRunID returns the plan run id in the request
+func getRunID(r *http.Request) int {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// handleGetPlan returns the status of a plan run
+func (s *server) handleGetPlan(w http.ResponseWriter, r *http.Request) {
+	var run *apiRun
+	s.call(func() {
+		if pr := s.getRun(getRunID(r)); pr != nil {
+			run = newAPIRun(pr)
+		}
+	})
+	if run == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// handleGetResults writes the results of a plan run in the format in the
+// request, json by default
+func (s *server) handleGetResults(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	writer := resultWriters[format]
+	if writer == nil {
+		http.Error(w, fmt.Sprintf("invalid output format: %s", format),
+			http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	found := false
+	var err error
+	s.call(func() {
+		if pr := s.getRun(getRunID(r)); pr != nil {
+			found = true
+			err = writer.write(&buf, pr.plan)
+		}
+	})
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(buf.Bytes())
+}
+
+// handleDeletePlan cancels a queued or running plan
+func (s *server) handleDeletePlan(w http.ResponseWriter, r *http.Request) {
+	var run *apiRun
+	cancelled := false
+	s.call(func() {
+		pr := s.getRun(getRunID(r))
+		if pr == nil {
+			return
+		}
+		cancelled = s.cancelRun(pr)
+		run = newAPIRun(pr)
+	})
+	if run == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "plan is not queued or running",
+			http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// newAPIHandler creates the handler of the http api
+func (s *server) newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", s.handleGetClients)
+	mux.HandleFunc("GET /plans", s.handleGetPlans)
+	mux.HandleFunc("POST /plans", s.handlePostPlan)
+	mux.HandleFunc("GET /plans/{id}", s.handleGetPlan)
+	mux.HandleFunc("GET /plans/{id}/results", s.handleGetResults)
+	mux.HandleFunc("DELETE /plans/{id}", s.handleDeletePlan)
+	return s.authAPI(mux)
+}
+
+// authAPI wraps handler and requires the pre-shared token of the server as
+// bearer token in api requests if the token is set
+func (s *server) authAPI(handler http.Handler) http.Handler {
+	if s.token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"),
+			"Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token),
+			[]byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackAddress checks if the host of address is a loopback address
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkAPIAuth checks if the http api with tlsConfig and token is protected;
+// without client certificates or token, the api must listen on a loopback
+// address
+func checkAPIAuth(address string, tlsConfig *tls.Config, token string) error {
+	if tlsConfig != nil &&
+		tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil
+	}
+	if token != "" || isLoopbackAddress(address) {
+		return nil
+	}
+	return fmt.Errorf("api on non-loopback address %s requires tls "+
+		"client certificates or a token", address)
+}
+
+// serveAPI runs the http api of the server
+func (s *server) serveAPI() {
+	log.Println("Server API listening on:", s.api.Addr)
+	if s.api.TLSConfig != nil {
+		log.Fatal(s.api.ListenAndServeTLS("", ""))
+	}
+	log.Println("Server API not using TLS")
+	log.Fatal(s.api.ListenAndServe())
+}
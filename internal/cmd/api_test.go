@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAPI tests submitting, queueing, querying and cancelling plans via the
+// http api
+func TestAPI(t *testing.T) {
+	config := NewConfig()
+	config.ServerAddress = "127.0.0.1:0"
+	config.APIAddress = "127.0.0.1:0"
+	config.PortRange = "1024:1032"
+	config.SenderDevice = "veth2"
+	config.ReceiverDevice = "veth4"
+	s := newServer(config, nil)
+	s.collectTime = 10 * time.Millisecond
+	go s.run()
+	api := httptest.NewServer(s.api.Handler)
+	defer api.Close()
+
+	var items bytes.Buffer
+	if err := resultWriters["items"].write(&items, newPlan(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path string, body []byte, want int) []byte {
+		req, err := http.NewRequest(method, api.URL+path,
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s %s: got %d, want %d: %s", method, path,
+				resp.StatusCode, want, buf.String())
+		}
+		return buf.Bytes()
+	}
+	getRun := func(b []byte) *apiRun {
+		run := &apiRun{}
+		if err := json.Unmarshal(b, run); err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+
+	// connected clients
+	in, out := net.Pipe()
+	defer func() {
+		_ = in.Close()
+	}()
+	c := newClientHandler(out, "", nil, nil, nil)
+	c.id = 1
+	c.reg = &MessageRegister{
+		Client:     1,
+		Version:    ProtocolVersion,
+		Features:   ClientFeatures,
+		Interfaces: []*MessageInterface{{Name: "veth2"}},
+	}
+	s.call(func() {
+		s.clients[1] = c
+	})
+	clients := []*apiClient{}
+	b := request("GET", "/clients", nil, http.StatusOK)
+	if err := json.Unmarshal(b, &clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].ID != 1 ||
+		clients[0].Interfaces[0].Name != "veth2" {
+		t.Errorf("got %s, want client 1", b)
+	}
+	s.call(func() {
+		delete(s.clients, 1)
+	})
+
+	// invalid plans
+	request("POST", "/plans", []byte("invalid"), http.StatusBadRequest)
+	request("POST", "/plans", []byte("{}"), http.StatusBadRequest)
+	request("POST", "/plans", []byte(`{"0":null}`), http.StatusBadRequest)
+	request("POST", "/plans", []byte(`{"1":{"ID":1}}`),
+		http.StatusBadRequest)
+
+	// submit plans; plans with the same clients are queued, plans with
+	// other clients run in parallel
+	run := getRun(request("POST", "/plans", items.Bytes(),
+		http.StatusCreated))
+	if run.ID != 1 || run.State != RunStateRunning || run.Items != 9 ||
+		run.DoneItems != 0 {
+		t.Errorf("got %v, want running plan 1", run)
+	}
+	run = getRun(request("POST", "/plans", items.Bytes(),
+		http.StatusCreated))
+	if run.ID != 2 || run.State != RunStateQueued {
+		t.Errorf("got %v, want queued plan 2", run)
+	}
+	config.SenderID = 3
+	config.ReceiverID = 4
+	var other bytes.Buffer
+	if err := resultWriters["items"].write(&other, newPlan(config)); err != nil {
+		t.Fatal(err)
+	}
+	run = getRun(request("POST", "/plans", other.Bytes(),
+		http.StatusCreated))
+	if run.ID != 3 || run.State != RunStateRunning {
+		t.Errorf("got %v, want running plan 3", run)
+	}
+	request("GET", "/plans/5", nil, http.StatusNotFound)
+
+	// cancel queued plan
+	run = getRun(request("DELETE", "/plans/2", nil, http.StatusOK))
+	if run.State != RunStateCancelled || run.Finished == nil {
+		t.Errorf("got %v, want cancelled plan 2", run)
+	}
+	request("DELETE", "/plans/2", nil, http.StatusConflict)
+	run = getRun(request("POST", "/plans", items.Bytes(),
+		http.StatusCreated))
+	if run.ID != 4 || run.State != RunStateQueued {
+		t.Errorf("got %v, want queued plan 4", run)
+	}
+
+	// cancel running plan, queued plan starts after it
+	run = getRun(request("DELETE", "/plans/1", nil, http.StatusOK))
+	if run.State != RunStateCancelled {
+		t.Errorf("got %s, want %s", run.State, RunStateCancelled)
+	}
+	for i := 0; i < 100 && run.Finished == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		run = getRun(request("GET", "/plans/1", nil, http.StatusOK))
+	}
+	if run.Finished == nil {
+		t.Errorf("plan not finished")
+	}
+	request("DELETE", "/plans/1", nil, http.StatusConflict)
+	run = getRun(request("GET", "/plans/4", nil, http.StatusOK))
+	if run.State != RunStateRunning {
+		t.Errorf("got %s, want %s", run.State, RunStateRunning)
+	}
+
+	// results
+	request("GET", "/plans/1/results?format=csv", nil, http.StatusOK)
+	request("GET", "/plans/1/results?format=invalid", nil,
+		http.StatusBadRequest)
+
+	// list plans
+	runs := []*apiRun{}
+	if err := json.Unmarshal(request("GET", "/plans", nil, http.StatusOK),
+		&runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 4 {
+		t.Errorf("got %d runs, want 4", len(runs))
+	}
+}
+
+// TestAPIAuth tests the token authentication of the http api and the checks
+// of unprotected api addresses
+func TestAPIAuth(t *testing.T) {
+	s := &server{token: "secret"}
+	api := httptest.NewServer(s.authAPI(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {})))
+	defer api.Close()
+
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, api.URL+"/clients",
+			nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%q: got %d, want %d", tc.auth, resp.StatusCode,
+				tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		address string
+		token   string
+		ok      bool
+	}{
+		{"127.0.0.1:8080", "", true},
+		{"[::1]:8080", "", true},
+		{"localhost:8080", "", true},
+		{":8080", "", false},
+		{"192.168.1.1:8080", "", false},
+		{"192.168.1.1:8080", "secret", true},
+	} {
+		err := checkAPIAuth(tc.address, nil, tc.token)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok %t", tc.address, err, tc.ok)
+		}
+	}
+}
@@ -1,61 +1,239 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
 const (
 	// NopInterval specifies the seconds between sending nop messages
 	NopInterval = 15
+
+	// ReconnectMinDelay is the initial delay before reconnecting to the
+	// server
+	ReconnectMinDelay = time.Second
+
+	// ReconnectMaxDelay is the maximum delay before reconnecting to the
+	// server
+	ReconnectMaxDelay = time.Minute
+)
+
+var (
+	// errRegistrationFailed is returned if the server does not accept
+	// the registration of the client
+	errRegistrationFailed = errors.New("registration failed")
 )
 
-// client stores information about a client
+// Client features
+const (
+	FeatureSender   = "sender"
+	FeatureReceiver = "receiver"
+	FeatureTTL      = "ttl"
+	FeatureMalform  = "malform"
+)
+
+// ClientFeatures are the features supported by clients
+var ClientFeatures = []string{
+	FeatureSender,
+	FeatureReceiver,
+	FeatureTTL,
+	FeatureMalform,
+}
+
+// getSoftwareVersion returns the software version of the client
+func getSoftwareVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	return info.Main.Version
+}
+
+// getInterfaces returns all network interfaces of the client
+func getInterfaces() []*MessageInterface {
+	interfaces := []*MessageInterface{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Println(err)
+		return interfaces
+	}
+	for _, iface := range ifaces {
+		i := &MessageInterface{
+			Name: iface.Name,
+			MAC:  iface.HardwareAddr,
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				i.IPs = append(i.IPs, ipnet.IP)
+			}
+		}
+		interfaces = append(interfaces, i)
+	}
+	return interfaces
+}
+
+// client stores information about a client; the results of its tests are
+// buffered in pending until they are sent to the server in the session
 type client struct {
-	conn    net.Conn
-	id      uint8
-	tests   chan *MessageTest
-	results chan *MessageResult
+	address   string
+	tlsConfig *tls.Config
+	id        uint8
+	token     string
+	session   string
+	results   chan *MessageResult
+	mutex     sync.Mutex
+	pending   []*MessageResult
+	ready     chan struct{}
 }
 
-// registerClient registers this client on the server
-func (c *client) registerClient() bool {
-	reg := MessageRegister{c.id}
-	return writeMessage(c.conn, &reg)
+// registerClient registers this client on the server via conn; it returns
+// errRegistrationFailed if the server does not accept the registration
+func (c *client) registerClient(conn net.Conn) error {
+	// send registration with client capabilities and the session token
+	// of a previous registration
+	reg := MessageRegister{
+		Client:     c.id,
+		Token:      c.token,
+		Version:    ProtocolVersion,
+		Software:   getSoftwareVersion(),
+		Protocols:  []uint16{ProtocolTCP, ProtocolUDP},
+		Features:   ClientFeatures,
+		Interfaces: getInterfaces(),
+		Session:    c.session,
+	}
+	if err := writeMessage(conn, &reg); err != nil {
+		log.Println("Error sending registration to server:", err)
+		return err
+	}
+
+	// wait for reply from server
+	msg, err := readMessage(conn)
+	if err != nil {
+		handleReadError(conn, err)
+		if isProtocolError(err) {
+			return errRegistrationFailed
+		}
+		return err
+	}
+	switch msg.GetType() {
+	case MessageTypeRegisterReply:
+	case MessageTypeError:
+		log.Println("Server reported error:", msg.(*MessageError).Reason)
+		return errRegistrationFailed
+	default:
+		reportProtocolError(conn, fmt.Sprintf(
+			"expected register reply message, got message type %d",
+			msg.GetType()))
+		return errRegistrationFailed
+	}
+	reply := msg.(*MessageRegisterReply)
+	if !reply.Accepted {
+		log.Printf("Server (protocol version %d) rejected registration: %s",
+			reply.Version, reply.Reason)
+		return errRegistrationFailed
+	}
+
+	// buffered results belong to the old session
+	if c.session != "" && reply.Session != c.session {
+		log.Printf("Server started new session, discarding %d "+
+			"buffered results", c.discardResults())
+	}
+	c.session = reply.Session
+	return nil
 }
 
-// sendNop sends a nop message to the server
-func (c *client) sendNop() bool {
+// sendNop sends a nop message to the server via conn
+func (c *client) sendNop(conn net.Conn) error {
 	nop := MessageNop{}
-	return writeMessage(c.conn, &nop)
+	return writeMessage(conn, &nop)
+}
+
+// sendResult returns the result message to the server via conn
+func (c *client) sendResult(conn net.Conn, result *MessageResult) error {
+	return writeMessage(conn, result)
+}
+
+// collectResults buffers the results of tests until they are sent to the
+// server, so tests and packet captures never wait for the connection
+func (c *client) collectResults() {
+	for result := range c.results {
+		c.mutex.Lock()
+		c.pending = append(c.pending, result)
+		c.mutex.Unlock()
+		select {
+		case c.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sendResults sends the buffered results to the server via conn; results
+// that cannot be sent stay buffered and are sent after reconnecting
+func (c *client) sendResults(conn net.Conn) error {
+	c.mutex.Lock()
+	results := c.pending
+	c.pending = nil
+	c.mutex.Unlock()
+	for i, result := range results {
+		if err := c.sendResult(conn, result); err != nil {
+			c.mutex.Lock()
+			c.pending = append(results[i:], c.pending...)
+			c.mutex.Unlock()
+			return err
+		}
+	}
+	return nil
 }
 
-// sendResult returns the result message to the server
-func (c *client) sendResult(result *MessageResult) bool {
-	return writeMessage(c.conn, result)
+// discardResults discards the buffered results and returns their number
+func (c *client) discardResults() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := len(c.pending)
+	c.pending = nil
+	return n
 }
 
-// receive gets messages from the server
-func (c *client) receive() {
-	defer close(c.tests)
+// receive gets messages from the server via conn and runs the tests in them;
+// it closes done when the connection is lost
+func (c *client) receive(conn net.Conn, done chan struct{}) {
+	defer close(done)
 	for {
 		// read message from server
-		msg := readMessage(c.conn)
-		if msg == nil {
+		msg, err := readMessage(conn)
+		if err != nil {
+			handleReadError(conn, err)
 			return
 		}
 
 		// handle test command messages
-		if msg.GetType() != MessageTypeTest {
-			continue
+		switch msg.GetType() {
+		case MessageTypeTest:
+		case MessageTypeError:
+			log.Println("Server reported error:",
+				msg.(*MessageError).Reason)
+			return
+		default:
+			reportProtocolError(conn, fmt.Sprintf(
+				"unexpected message type %d", msg.GetType()))
+			return
 		}
 		test, ok := msg.(*MessageTest)
 		if !ok {
 			log.Println("Received invalid test message from server")
 			continue
 		}
-		c.tests <- test
+		c.runTest(test)
 	}
 }
 
@@ -68,60 +246,97 @@ func (c *client) runTest(test *MessageTest) {
 	}
 }
 
-// run runs this client
-func (c *client) run() {
+// dial creates a connection to the server
+func (c *client) dial() (net.Conn, error) {
+	if c.tlsConfig != nil {
+		return tls.Dial("tcp", c.address, c.tlsConfig)
+	}
+	return net.Dial("tcp", c.address)
+}
+
+// serve registers this client on the server and handles the connection conn
+// until it is lost. It returns whether the client was registered and an
+// error; errRegistrationFailed means the client should not reconnect
+func (c *client) serve(conn net.Conn) (bool, error) {
 	defer func() {
-		_ = c.conn.Close()
+		_ = conn.Close()
 	}()
 
-	log.Println("Client connected to:", c.conn.RemoteAddr())
+	log.Println("Client connected to:", conn.RemoteAddr())
 
 	// register client
-	if !c.registerClient() {
-		return
+	if err := c.registerClient(conn); err != nil {
+		return false, err
 	}
 	log.Println("Client registered on server")
 
+	// send results of tests that ran while the connection was lost
+	if err := c.sendResults(conn); err != nil {
+		log.Println("Error sending to server:", err)
+		return true, err
+	}
+
 	// create ticker for nop messages
 	ticker := time.NewTicker(time.Second * NopInterval)
 	defer ticker.Stop()
 
 	// start receiving messages
-	go c.receive()
+	done := make(chan struct{})
+	go c.receive(conn, done)
 
 	log.Println("Client ready and waiting for test commands")
 	for {
 		select {
 		case <-ticker.C:
-			if !c.sendNop() {
-				return
+			if err := c.sendNop(conn); err != nil {
+				log.Println("Error sending to server:", err)
+				return true, err
 			}
-		case test, more := <-c.tests:
-			if !more {
-				return
-			}
-			c.runTest(test)
-		case result := <-c.results:
-			if !c.sendResult(result) {
-				return
+		case <-done:
+			return true, nil
+		case <-c.ready:
+			if err := c.sendResults(conn); err != nil {
+				log.Println("Error sending to server:", err)
+				return true, err
 			}
 		}
 	}
 }
 
-// newClient connects to serverAddress and creates a new client
-func newClient(serverAddress string, id uint8) *client {
-	// create connection to server
-	conn, err := net.Dial("tcp", serverAddress)
-	if err != nil {
-		log.Fatal(err)
+// run runs this client; if the connection to the server fails or is lost,
+// it reconnects with exponential backoff and resumes its session
+func (c *client) run() {
+	go c.collectResults()
+	delay := ReconnectMinDelay
+	for {
+		conn, err := c.dial()
+		if err != nil {
+			log.Println("Error connecting to server:", err)
+		} else {
+			registered, err := c.serve(conn)
+			if errors.Is(err, errRegistrationFailed) {
+				return
+			}
+			if registered {
+				delay = ReconnectMinDelay
+			}
+		}
+
+		log.Printf("Reconnecting to server in %s", delay)
+		time.Sleep(delay)
+		delay = min(2*delay, ReconnectMaxDelay)
 	}
+}
 
-	// return client
+// newClient creates a new client that connects to the server address in
+// config
+func newClient(config *Config) *client {
 	return &client{
-		conn,
-		id,
-		make(chan *MessageTest),
-		make(chan *MessageResult),
+		address:   config.ServerAddress,
+		tlsConfig: newClientTLSConfig(config),
+		id:        config.ClientID,
+		token:     config.Token,
+		results:   make(chan *MessageResult),
+		ready:     make(chan struct{}, 1),
 	}
 }
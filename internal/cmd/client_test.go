@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestClientResults tests buffering results of tests until they are sent to
+// the server
+func TestClientResults(t *testing.T) {
+	c := newClient(NewConfig())
+	go c.collectResults()
+	waitResults := func(n int) {
+		for {
+			<-c.ready
+			c.mutex.Lock()
+			pending := len(c.pending)
+			c.mutex.Unlock()
+			if pending == n {
+				return
+			}
+		}
+	}
+
+	// results are buffered while the connection is lost
+	for i := uint32(0); i < 2; i++ {
+		c.results <- &MessageResult{ID: i, Result: ResultPass}
+	}
+	waitResults(2)
+	lost, _ := net.Pipe()
+	_ = lost.Close()
+	if err := c.sendResults(lost); err == nil {
+		t.Errorf("got no error for lost connection")
+	}
+
+	// buffered results are sent after reconnecting
+	in, out := net.Pipe()
+	if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = c.sendResults(in)
+	}()
+	for i := uint32(0); i < 2; i++ {
+		msg, err := readMessage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := msg.(*MessageResult); r.ID != i {
+			t.Errorf("got result %d, want %d", r.ID, i)
+		}
+	}
+
+	// buffered results of old sessions are discarded
+	c.results <- &MessageResult{ID: 2, Result: ResultPass}
+	waitResults(1)
+	c.session = "old"
+	go func() {
+		_, _ = readMessage(out)
+		_ = writeMessage(out, &MessageRegisterReply{
+			Accepted: true,
+			Version:  ProtocolVersion,
+			Session:  "new",
+		})
+	}()
+	if err := c.registerClient(in); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.discardResults(); n != 0 {
+		t.Errorf("got %d buffered results, want 0", n)
+	}
+}
@@ -1,25 +1,59 @@
 package cmd
 
+import "log"
+
 // Run is the main entry point
 func Run() {
 	// create config
 	config := NewConfig()
 	config.ParseCommandLine()
 
+	// compare result files?
+	if len(config.DiffFiles) > 0 {
+		diff := newPlanDiff(newPlanFromFile(config.DiffFiles[0]),
+			newPlanFromFile(config.DiffFiles[1]))
+		diff.printResults()
+		diff.printPacketDiffs()
+		return
+	}
+
+	// import ruleset into plan file?
+	if config.ImportFile != "" {
+		importPlan(config)
+		return
+	}
+
+	// serve metrics?
+	if config.MetricsAddress != "" {
+		go serveMetrics(config.MetricsAddress)
+	}
+
 	// run as server?
 	if config.ServerMode {
+		// run until stopped and get plans via http api?
+		if config.APIAddress != "" {
+			newServer(config, nil).run()
+			return
+		}
+
 		plan := newPlan(config)
-		newServer(config.ServerAddress, plan).run()
+		newServer(config, plan).run()
 		if config.OutFile != "" {
-			plan.writeFile(config.OutFile)
+			plan.writeFile(config.OutFile, config.Format)
+		}
+		if config.PcapFile != "" {
+			plan.writePcapFile(config.PcapFile)
 		}
 		plan.printResults()
 		if config.ShowDiffs {
 			plan.printPacketDiffs()
 		}
+		if !plan.checkExpectations() {
+			log.Fatal("Results do not match expected results")
+		}
 		return
 	}
 
 	// run as client
-	newClient(config.ServerAddress, config.ClientID).run()
+	newClient(config).run()
 }
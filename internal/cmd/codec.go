@@ -0,0 +1,319 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+var (
+	// errShortMessage is returned when decoding a message that is too
+	// short for its fields
+	errShortMessage = fmt.Errorf("%w: message too short", ErrDecode)
+)
+
+// messageEncoder encodes message fields in binary format
+type messageEncoder struct {
+	buf bytes.Buffer
+}
+
+// putUint8 encodes v
+func (e *messageEncoder) putUint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+// putUint16 encodes v
+func (e *messageEncoder) putUint16(v uint16) {
+	e.buf.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+// putUint32 encodes v
+func (e *messageEncoder) putUint32(v uint32) {
+	e.buf.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+// putBool encodes v
+func (e *messageEncoder) putBool(v bool) {
+	if v {
+		e.putUint8(1)
+		return
+	}
+	e.putUint8(0)
+}
+
+// putBytes encodes v with its length
+func (e *messageEncoder) putBytes(v []byte) {
+	e.putUint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+// putString encodes v with its length
+func (e *messageEncoder) putString(v string) {
+	e.putBytes([]byte(v))
+}
+
+// putTime encodes v as nanoseconds since the unix epoch; the zero time is
+// encoded as 0
+func (e *messageEncoder) putTime(v time.Time) {
+	ns := int64(0)
+	if !v.IsZero() {
+		ns = v.UnixNano()
+	}
+	e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(ns)))
+}
+
+// bytes returns the encoded message fields
+func (e *messageEncoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// messageDecoder decodes message fields in binary format; after the first
+// error, all decoded values are zero values
+type messageDecoder struct {
+	b   []byte
+	err error
+}
+
+// get returns the next n bytes
+func (d *messageDecoder) get(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = errShortMessage
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+// getUint8 decodes an uint8
+func (d *messageDecoder) getUint8() uint8 {
+	b := d.get(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// getUint16 decodes an uint16
+func (d *messageDecoder) getUint16() uint16 {
+	b := d.get(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// getUint32 decodes an uint32
+func (d *messageDecoder) getUint32() uint32 {
+	b := d.get(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// getBool decodes a bool
+func (d *messageDecoder) getBool() bool {
+	return d.getUint8() != 0
+}
+
+// getBytes decodes a byte slice with its length; an empty byte slice is
+// decoded as nil
+func (d *messageDecoder) getBytes() []byte {
+	length := d.getUint32()
+	b := d.get(int(length))
+	if len(b) == 0 {
+		return nil
+	}
+	return bytes.Clone(b)
+}
+
+// getString decodes a string with its length
+func (d *messageDecoder) getString() string {
+	return string(d.getBytes())
+}
+
+// getTime decodes a time
+func (d *messageDecoder) getTime() time.Time {
+	b := d.get(8)
+	if b == nil {
+		return time.Time{}
+	}
+	ns := int64(binary.BigEndian.Uint64(b))
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// more checks if there is more data to decode; it is used for optional
+// fields that were appended to messages in newer versions
+func (d *messageDecoder) more() bool {
+	return d.err == nil && len(d.b) > 0
+}
+
+// getCount decodes the number of elements of a slice; it fails if the
+// remaining data cannot contain count elements of at least minSize bytes
+func (d *messageDecoder) getCount(minSize int) int {
+	count := int(d.getUint32())
+	if count*minSize > len(d.b) {
+		d.err = errShortMessage
+		return 0
+	}
+	return count
+}
+
+// encode encodes the message
+func (m *MessageNop) encode(e *messageEncoder) {}
+
+// decode decodes the message
+func (m *MessageNop) decode(d *messageDecoder) {}
+
+// encode encodes the message
+func (m *MessageRegister) encode(e *messageEncoder) {
+	e.putUint8(m.Client)
+	e.putString(m.Token)
+	e.putUint16(m.Version)
+	e.putString(m.Software)
+	e.putUint32(uint32(len(m.Protocols)))
+	for _, p := range m.Protocols {
+		e.putUint16(p)
+	}
+	e.putUint32(uint32(len(m.Features)))
+	for _, f := range m.Features {
+		e.putString(f)
+	}
+	e.putUint32(uint32(len(m.Interfaces)))
+	for _, i := range m.Interfaces {
+		e.putString(i.Name)
+		e.putBytes(i.MAC)
+		e.putUint32(uint32(len(i.IPs)))
+		for _, ip := range i.IPs {
+			e.putBytes(ip)
+		}
+	}
+	e.putString(m.Session)
+}
+
+// decode decodes the message
+func (m *MessageRegister) decode(d *messageDecoder) {
+	m.Client = d.getUint8()
+	m.Token = d.getString()
+	m.Version = d.getUint16()
+	m.Software = d.getString()
+	for n := d.getCount(2); n > 0; n-- {
+		m.Protocols = append(m.Protocols, d.getUint16())
+	}
+	for n := d.getCount(4); n > 0; n-- {
+		m.Features = append(m.Features, d.getString())
+	}
+	for n := d.getCount(12); n > 0; n-- {
+		i := &MessageInterface{
+			Name: d.getString(),
+			MAC:  d.getBytes(),
+		}
+		for n := d.getCount(4); n > 0; n-- {
+			i.IPs = append(i.IPs, d.getBytes())
+		}
+		m.Interfaces = append(m.Interfaces, i)
+	}
+	if d.more() {
+		m.Session = d.getString()
+	}
+}
+
+// encode encodes the message
+func (m *MessageRegisterReply) encode(e *messageEncoder) {
+	e.putBool(m.Accepted)
+	e.putUint16(m.Version)
+	e.putString(m.Reason)
+	e.putString(m.Session)
+}
+
+// decode decodes the message
+func (m *MessageRegisterReply) decode(d *messageDecoder) {
+	m.Accepted = d.getBool()
+	m.Version = d.getUint16()
+	m.Reason = d.getString()
+	if d.more() {
+		m.Session = d.getString()
+	}
+}
+
+// encode encodes the message
+func (m *MessageTest) encode(e *messageEncoder) {
+	e.putUint32(m.ID)
+	e.putBool(m.Initiate)
+	e.putString(m.Device)
+	e.putBytes(m.SrcMAC)
+	e.putBytes(m.DstMAC)
+	e.putBytes(m.SrcIP)
+	e.putBytes(m.DstIP)
+	e.putUint16(m.Protocol)
+	e.putUint16(m.SrcPort)
+	e.putUint16(m.DstPort)
+	e.putUint8(m.TTL)
+	e.putString(m.Malform)
+	e.putUint32(m.Run)
+}
+
+// decode decodes the message
+func (m *MessageTest) decode(d *messageDecoder) {
+	m.ID = d.getUint32()
+	m.Initiate = d.getBool()
+	m.Device = d.getString()
+	m.SrcMAC = d.getBytes()
+	m.DstMAC = d.getBytes()
+	m.SrcIP = d.getBytes()
+	m.DstIP = d.getBytes()
+	m.Protocol = d.getUint16()
+	m.SrcPort = d.getUint16()
+	m.DstPort = d.getUint16()
+	if d.more() {
+		m.TTL = d.getUint8()
+	}
+	if d.more() {
+		m.Malform = d.getString()
+	}
+	if d.more() {
+		m.Run = d.getUint32()
+	}
+}
+
+// encode encodes the message
+func (m *MessageResult) encode(e *messageEncoder) {
+	e.putUint32(m.ID)
+	e.putUint8(m.Result)
+	e.putBytes(m.Packet)
+	e.putTime(m.Time)
+	e.putUint8(m.Role)
+	e.putUint32(m.Run)
+}
+
+// decode decodes the message
+func (m *MessageResult) decode(d *messageDecoder) {
+	m.ID = d.getUint32()
+	m.Result = d.getUint8()
+	m.Packet = d.getBytes()
+	m.Time = d.getTime()
+	if d.more() {
+		m.Role = d.getUint8()
+	}
+	if d.more() {
+		m.Run = d.getUint32()
+	}
+}
+
+// encode encodes the message
+func (m *MessageError) encode(e *messageEncoder) {
+	e.putString(m.Reason)
+}
+
+// decode decodes the message
+func (m *MessageError) decode(d *messageDecoder) {
+	m.Reason = d.getString()
+}
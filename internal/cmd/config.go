@@ -5,10 +5,18 @@ import (
 	"log"
 	"math"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 )
 
+// Plan modes
+const (
+	ModePorts    = "ports"
+	ModeTTL      = "ttl"
+	ModeFirewalk = "firewalk"
+)
+
 // Config contains the configuration
 type Config struct {
 	// ServerMode determines if we run as a server or a client
@@ -17,6 +25,27 @@ type Config struct {
 	// ServerAddress is the address of the server
 	ServerAddress string
 
+	// APIAddress is the address the server's HTTP API listens on
+	APIAddress string
+
+	// MetricsAddress is the address the metrics endpoint listens on
+	MetricsAddress string
+
+	// TUI determines if the server shows its progress in a terminal ui
+	TUI bool
+
+	// TLSCert is the certificate file used for tls
+	TLSCert string
+
+	// TLSKey is the private key file used for tls
+	TLSKey string
+
+	// TLSCA is the ca certificate file used to verify the tls peer
+	TLSCA string
+
+	// Token is the pre-shared token clients use to register on the server
+	Token string
+
 	// ClientID is the id of the client
 	ClientID uint8
 
@@ -32,6 +61,10 @@ type Config struct {
 	// ReceiverDevice is the name of the receiver's network interface
 	ReceiverDevice string
 
+	// Hops is the list of intermediate receiving clients and their
+	// network interfaces between the sender and the receiver
+	Hops string
+
 	// SenderSrcMAC is the sender's source MAC address
 	SenderSrcMAC string
 
@@ -65,11 +98,54 @@ type Config struct {
 	// PortRange is the tested port range
 	PortRange string
 
+	// Mode is the plan mode, ports, ttl or firewalk
+	Mode string
+
+	// MaxTTL is the maximum ttl or hop limit of probes in ttl mode
+	MaxTTL uint8
+
+	// GatewayHops is the number of hops from the sender to the middlebox
+	// in firewalk mode
+	GatewayHops uint8
+
+	// Malform is the list of malformations of probes or "all"
+	Malform string
+
 	// OutFile is the file the plan and its results are written to
 	OutFile string
 
+	// PcapFile is the pcapng file all packets are written to
+	PcapFile string
+
+	// Format is the format of the output file
+	Format string
+
 	// ShowDiffs specifies if packet differences are shown in results
 	ShowDiffs bool
+
+	// Expect is the list of expected results of port ranges
+	Expect string
+
+	// PlanFile is the file the plan items are read from
+	PlanFile string
+
+	// ImportFormat is the format of the imported ruleset, iptables or nft
+	ImportFormat string
+
+	// ImportFile is the file the ruleset is imported from
+	ImportFile string
+
+	// ImportPlanFile is the file the imported plan is written to
+	ImportPlanFile string
+
+	// ImportChain is the chain of the imported ruleset
+	ImportChain string
+
+	// ImportForce imports rulesets with rules that cannot be imported
+	ImportForce bool
+
+	// DiffFiles are the two result files compared in diff mode
+	DiffFiles []string
 }
 
 // getMACFromString converts a string to a hardware (MAC) address
@@ -126,11 +202,11 @@ func (c *Config) GetReceiverDstIP() net.IP {
 	return getIPFromString(c.ReceiverDstIP)
 }
 
-// GetPortRange returns the first and last port of the port range
-func (c *Config) GetPortRange() (first uint16, last uint16) {
+// parsePortRange returns the first and last port of the port range in pr
+func parsePortRange(pr string) (first uint16, last uint16) {
 	// get first and last port as string
 	fs, ls := "", ""
-	s := strings.Split(c.PortRange, ":")
+	s := strings.Split(pr, ":")
 	switch len(s) {
 	case 1:
 		fs = s[0]
@@ -160,6 +236,109 @@ func (c *Config) GetPortRange() (first uint16, last uint16) {
 	return
 }
 
+// GetPortRange returns the first and last port of the port range
+func (c *Config) GetPortRange() (first uint16, last uint16) {
+	return parsePortRange(c.PortRange)
+}
+
+// Expectation is an expected result of a port range
+type Expectation struct {
+	FirstPort uint16
+	LastPort  uint16
+	Result    string
+}
+
+// GetExpectations returns the expected results of port ranges
+func (c *Config) GetExpectations() []*Expectation {
+	expectations := []*Expectation{}
+	if c.Expect == "" {
+		return expectations
+	}
+	for _, e := range strings.Split(c.Expect, ",") {
+		// get port range and result as string
+		s := strings.Split(e, "=")
+		if len(s) != 2 {
+			return nil
+		}
+
+		// parse result string
+		if _, ok := parsePlanResult(s[1]); !ok {
+			return nil
+		}
+
+		// parse port range string, "*" matches all ports
+		first, last := uint16(1), uint16(math.MaxUint16)
+		if s[0] != "*" {
+			first, last = parsePortRange(s[0])
+			if first == 0 && last == 0 {
+				return nil
+			}
+		}
+
+		expectations = append(expectations, &Expectation{
+			FirstPort: first,
+			LastPort:  last,
+			Result:    s[1],
+		})
+	}
+	return expectations
+}
+
+// Hop is an intermediate receiving client between the sender and the
+// receiver
+type Hop struct {
+	ClientID uint8
+	Device   string
+}
+
+// GetHops returns the intermediate receiving clients in the order from the
+// sender to the receiver
+func (c *Config) GetHops() []*Hop {
+	hops := []*Hop{}
+	if c.Hops == "" {
+		return hops
+	}
+	ids := map[uint64]bool{uint64(c.ReceiverID): true}
+	for _, h := range strings.Split(c.Hops, ",") {
+		// get client id and device
+		s := strings.Split(h, ":")
+		if len(s) != 2 || s[1] == "" {
+			return nil
+		}
+		id, err := strconv.ParseUint(s[0], 10, 8)
+		if err != nil || id == 0 || ids[id] {
+			return nil
+		}
+		ids[id] = true
+
+		hops = append(hops, &Hop{
+			ClientID: uint8(id),
+			Device:   s[1],
+		})
+	}
+	return hops
+}
+
+// GetMalforms returns the malformations of probes; it returns nil if the
+// malformations are invalid
+func (c *Config) GetMalforms() []string {
+	switch c.Malform {
+	case "":
+		return []string{}
+	case "all":
+		return malforms
+	}
+	m := []string{}
+	for _, malform := range strings.Split(c.Malform, ",") {
+		if !slices.Contains(malforms, malform) ||
+			slices.Contains(m, malform) {
+			return nil
+		}
+		m = append(m, malform)
+	}
+	return m
+}
+
 // ParseCommandLine fills the config from command line arguments
 func (c *Config) ParseCommandLine() {
 	// configure command line arguments
@@ -167,6 +346,23 @@ func (c *Config) ParseCommandLine() {
 		"run as server (default: run as client)")
 	flag.StringVar(&c.ServerAddress, "address", c.ServerAddress,
 		"set address to connect to (client mode) or listen on (server mode)")
+	flag.StringVar(&c.APIAddress, "api", c.APIAddress,
+		"set address of the HTTP API and run the server until it is "+
+			"stopped (server mode)")
+	flag.StringVar(&c.MetricsAddress, "metrics", c.MetricsAddress,
+		"set address of the prometheus metrics endpoint")
+	flag.BoolVar(&c.TUI, "tui", c.TUI,
+		"show connected clients, progress and results in a terminal ui "+
+			"(server mode)")
+	flag.StringVar(&c.TLSCert, "cert", c.TLSCert,
+		"set tls certificate file")
+	flag.StringVar(&c.TLSKey, "key", c.TLSKey,
+		"set tls private key file")
+	flag.StringVar(&c.TLSCA, "ca", c.TLSCA,
+		"set tls ca certificate file to verify the server (client mode) "+
+			"or client certificates (server mode)")
+	flag.StringVar(&c.Token, "token", c.Token,
+		"set pre-shared token for client registration")
 	cid := flag.Uint("id", uint(c.ClientID), "set id of the client")
 	sid := flag.Uint("sid", uint(c.SenderID), "set id of the sending client")
 	rid := flag.Uint("rid", uint(c.ReceiverID), "set id of the receiving client")
@@ -174,6 +370,9 @@ func (c *Config) ParseCommandLine() {
 		"set device of the sending client")
 	flag.StringVar(&c.ReceiverDevice, "rdev", c.ReceiverDevice,
 		"set device of the receiving client")
+	flag.StringVar(&c.Hops, "hops", c.Hops,
+		"set ids and devices of intermediate receiving clients "+
+			"between sender and receiver, e.g., \"3:veth6,4:veth8\"")
 	flag.StringVar(&c.SenderSrcMAC, "ssmac", c.SenderSrcMAC,
 		"set source MAC of the sending client")
 	flag.StringVar(&c.SenderDstMAC, "sdmac", c.SenderDstMAC,
@@ -196,14 +395,58 @@ func (c *Config) ParseCommandLine() {
 		"set source port of the sending client")
 	flag.StringVar(&c.PortRange, "ports", c.PortRange,
 		"set port range to be tested")
+	flag.StringVar(&c.Mode, "mode", c.Mode,
+		"set plan mode: ports, ttl or firewalk")
+	maxTTL := flag.Uint("maxttl", uint(c.MaxTTL),
+		"set maximum ttl or hop limit of probes in ttl mode")
+	gwHops := flag.Uint("gwhops", uint(c.GatewayHops),
+		"set number of hops from the sending client to the middlebox "+
+			"in firewalk mode")
+	flag.StringVar(&c.Malform, "malform", c.Malform,
+		"send malformed probes: all or list of malformations, e.g., "+
+			"\"land,bad-ip-checksum\"")
 	flag.StringVar(&c.OutFile, "out", c.OutFile,
 		"set output file")
+	flag.StringVar(&c.PcapFile, "pcap", c.PcapFile,
+		"set pcapng file for probe and captured packets")
+	flag.StringVar(&c.Format, "format", c.Format,
+		"set format of output file: items, csv, json, junit or html")
 	flag.BoolVar(&c.ShowDiffs, "diffs", c.ShowDiffs,
 		"show packet diffs in results")
+	flag.StringVar(&c.PlanFile, "plan", c.PlanFile,
+		"read plan items from file instead of creating them")
+	flag.BoolVar(&c.ImportForce, "force", c.ImportForce,
+		"import ruleset even if some rules cannot be imported")
+	flag.StringVar(&c.ImportChain, "chain", c.ImportChain,
+		"set chain of imported ruleset "+
+			"(default: FORWARD chain or chain with forward hook)")
+	flag.StringVar(&c.Expect, "expect", c.Expect,
+		"set expected results of port ranges, e.g., "+
+			"\"22=pass,23=reject,*=drop\"")
 
 	// parse command line arguments
 	flag.Parse()
 
+	// check diff command and its result files
+	if args := flag.Args(); len(args) > 0 && args[0] == "diff" {
+		if len(args) != 3 {
+			log.Fatal("diff requires two result files")
+		}
+		c.DiffFiles = args[1:]
+		return
+	}
+
+	// check import command and its files
+	if args := flag.Args(); len(args) > 0 && args[0] == "import" {
+		if len(args) != 4 {
+			log.Fatal("import requires format, ruleset file " +
+				"and plan file")
+		}
+		c.ImportFormat = args[1]
+		c.ImportFile = args[2]
+		c.ImportPlanFile = args[3]
+	}
+
 	// set client id, sender id, receiver id
 	for _, i := range []*uint{cid, sid, rid} {
 		if *i > math.MaxUint8 {
@@ -226,21 +469,55 @@ func (c *Config) ParseCommandLine() {
 	}
 	c.SenderSrcPort = uint16(*ssport)
 
+	// check plan mode, maximum ttl and gateway hops
+	if c.Mode != ModePorts && c.Mode != ModeTTL && c.Mode != ModeFirewalk {
+		log.Fatal("invalid mode: ", c.Mode)
+	}
+	if *maxTTL == 0 || *maxTTL > math.MaxUint8 {
+		log.Fatal("invalid maximum ttl: ", *maxTTL)
+	}
+	c.MaxTTL = uint8(*maxTTL)
+	if *gwHops == 0 || *gwHops >= math.MaxUint8 {
+		log.Fatal("invalid gateway hops: ", *gwHops)
+	}
+	c.GatewayHops = uint8(*gwHops)
+	if c.Mode == ModeFirewalk && c.Hops != "" {
+		log.Fatal("hops are not supported in firewalk mode")
+	}
+
+	// check output format
+	if resultWriters[c.Format] == nil {
+		log.Fatal("invalid output format: ", c.Format)
+	}
+
 	// check port range
 	if c.ServerMode {
 		if first, last := c.GetPortRange(); first == 0 && last == 0 {
 			log.Fatal("invalid port range: ", c.PortRange)
 		}
+		if c.GetExpectations() == nil {
+			log.Fatal("invalid expected results: ", c.Expect)
+		}
+		if c.GetHops() == nil {
+			log.Fatal("invalid hops: ", c.Hops)
+		}
+		if c.GetMalforms() == nil {
+			log.Fatal("invalid malformations: ", c.Malform)
+		}
 	}
 }
 
 // NewConfig creates a new Config
 func NewConfig() *Config {
 	return &Config{
-		ClientID:   1,
-		SenderID:   1,
-		ReceiverID: 2,
-		Protocol:   6,
-		PortRange:  "1:65535",
+		ClientID:    1,
+		SenderID:    1,
+		ReceiverID:  2,
+		Protocol:    6,
+		PortRange:   "1:65535",
+		Mode:        ModePorts,
+		MaxTTL:      30,
+		GatewayHops: 1,
+		Format:      "items",
 	}
 }
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// planDiffRange is a port range with the same change of plan results
+type planDiffRange struct {
+	flow      string
+	before    uint8
+	after     uint8
+	firstPort uint16
+	lastPort  uint16
+}
+
+// planDiffResults is a collection of changed results of two plans for
+// printing
+type planDiffResults struct {
+	ranges []*planDiffRange
+}
+
+// String converts planDiffResults to a string
+func (p *planDiffResults) String() string {
+	s := ""
+	flow := ""
+	for _, r := range p.ranges {
+		if r.flow != flow {
+			flow = r.flow
+			s += fmt.Sprintf("%s\n", flow)
+		}
+		s += fmt.Sprintf("%s\t%s -> %s\n",
+			portRangeString(r.firstPort, r.lastPort),
+			planResultString(r.before), planResultString(r.after))
+	}
+	return s
+}
+
+// add adds a changed result to the collection of changed results; expects
+// results added with increasing port numbers per flow
+func (p *planDiffResults) add(flow string, port uint16, before, after uint8) {
+	if length := len(p.ranges); length > 0 &&
+		p.ranges[length-1].flow == flow &&
+		p.ranges[length-1].before == before &&
+		p.ranges[length-1].after == after &&
+		p.ranges[length-1].lastPort == port-1 {
+		p.ranges[length-1].lastPort = port
+	} else {
+		newRange := &planDiffRange{
+			flow:      flow,
+			before:    before,
+			after:     after,
+			firstPort: port,
+			lastPort:  port,
+		}
+		p.ranges = append(p.ranges, newRange)
+	}
+}
+
+// planDiffKey identifies a plan item in two different plans
+type planDiffKey struct {
+	flow string
+	port uint16
+}
+
+// planDiff compares the results of two plans
+type planDiff struct {
+	before map[planDiffKey]*planItem
+	after  map[planDiffKey]*planItem
+	keys   []planDiffKey
+}
+
+// addItems adds the result items of plan to the plan items in m
+func (p *planDiff) addItems(m map[planDiffKey]*planItem, plan *plan) {
+	for _, item := range plan.getResultItems() {
+		key := planDiffKey{item.getFlow(), item.Port}
+		if p.before[key] == nil && p.after[key] == nil {
+			p.keys = append(p.keys, key)
+		}
+		m[key] = item
+	}
+}
+
+// getResult returns the plan result of the plan item identified by key in m
+func (p *planDiff) getResult(m map[planDiffKey]*planItem,
+	key planDiffKey) uint8 {
+	if item := m[key]; item != nil {
+		return item.getResult()
+	}
+	return planResultMissing
+}
+
+// getResults returns all changed results
+func (p *planDiff) getResults() *planDiffResults {
+	results := &planDiffResults{}
+	for _, key := range p.keys {
+		before := p.getResult(p.before, key)
+		after := p.getResult(p.after, key)
+		if before != after {
+			results.add(key.flow, key.port, before, after)
+		}
+	}
+	return results
+}
+
+// printResults prints changed results to the console
+func (p *planDiff) printResults() {
+	log.Printf("Printing changed results:\n%s", p.getResults())
+}
+
+// printPacketDiffs prints packet differences that are new in the second
+// plan to the console
+func (p *planDiff) printPacketDiffs() {
+	for _, key := range p.keys {
+		after := p.after[key]
+		if after == nil {
+			continue
+		}
+		diffs := planPacketDiffs{}
+		for _, d := range after.PacketDiffs {
+			if before := p.before[key]; before != nil &&
+				before.PacketDiffs.contains(d) {
+				continue
+			}
+			diffs.add(d.Field, d.Sender, d.Receiver)
+		}
+		if len(diffs) > 0 {
+			log.Printf("%s port %d new packet differences:\n%s",
+				key.flow, key.port, &diffs)
+		}
+	}
+}
+
+// newPlanDiff creates a new comparison of the plans before and after
+func newPlanDiff(before, after *plan) *planDiff {
+	p := &planDiff{
+		before: make(map[planDiffKey]*planItem),
+		after:  make(map[planDiffKey]*planItem),
+	}
+	p.addItems(p.before, before)
+	p.addItems(p.after, after)
+
+	// sort keys by flow and port
+	sort.Slice(p.keys, func(i, j int) bool {
+		if p.keys[i].flow != p.keys[j].flow {
+			return p.keys[i].flow < p.keys[j].flow
+		}
+		return p.keys[i].port < p.keys[j].port
+	})
+	return p
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"log"
+	"os"
+)
+
+// getExamplePlanDiffPlans is a init helper for the planDiff examples
+func getExamplePlanDiffPlans() (*plan, *plan) {
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.SenderSrcIP = "192.168.1.1"
+	config.SenderDstIP = "192.168.1.2"
+	config.PortRange = "1024:1032"
+	return newPlan(config), newPlan(config)
+}
+
+// Example_planDiff_printResults runs printResults() with changed results
+func Example_planDiff_printResults() {
+	// init
+	before, after := getExamplePlanDiffPlans()
+
+	// create result messages
+	pass := []*MessageResult{{Result: ResultPass}}
+	reset := []*MessageResult{{Result: ResultTCPReset}}
+
+	// set results before and after
+	for i := uint32(0); i < 3; i++ {
+		before.items[i].ReceiverResults = pass
+		after.items[i].ReceiverResults = pass
+	}
+	for i := uint32(3); i < 6; i++ {
+		after.items[i].ReceiverResults = pass
+	}
+	before.items[8].SenderResults = reset
+
+	// check output
+	newPlanDiff(before, after).printResults()
+
+	// Output:
+	// Printing changed results:
+	// tcp 192.168.1.1 -> 192.168.1.2
+	// 1027:1029	drop -> pass
+	// 1032	reject -> drop
+}
+
+// Example_planDiff_printPacketDiffs runs printPacketDiffs() with new packet
+// differences
+func Example_planDiff_printPacketDiffs() {
+	// init
+	before, after := getExamplePlanDiffPlans()
+
+	// set packet differences before and after
+	before.items[0].PacketDiffs.add("SrcPort", "1", "2")
+	after.items[0].PacketDiffs.add("SrcPort", "1", "2")
+	after.items[1].PacketDiffs.add("SrcIP", "192.168.1.1", "10.0.0.1")
+
+	// check output
+	newPlanDiff(before, after).printPacketDiffs()
+
+	// Output:
+	// tcp 192.168.1.1 -> 192.168.1.2 port 1025 new packet differences:
+	// SrcIP: 192.168.1.1 -> 10.0.0.1
+}
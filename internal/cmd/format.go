@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// resultWriter writes the plan items and results of a plan in a specific
+// format
+type resultWriter interface {
+	write(w io.Writer, p *plan) error
+}
+
+// resultWriters contains all result writers identified by their format
+var resultWriters = map[string]resultWriter{
+	"items": &itemsWriter{},
+	"csv":   &csvWriter{},
+	"json":  &jsonWriter{},
+	"junit": &junitWriter{},
+	"html":  &htmlWriter{},
+}
+
+// itemsWriter writes all plan items including results as json
+type itemsWriter struct{}
+
+// write writes the plan items of p to w
+func (i *itemsWriter) write(w io.Writer, p *plan) error {
+	j, err := json.MarshalIndent(p.items, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(j)
+	return err
+}
+
+// csvWriter writes one row per plan item as csv
+type csvWriter struct{}
+
+// getResultsString converts the results to a string
+func (c *csvWriter) getResultsString(results []*MessageResult) string {
+	s := []string{}
+	for _, r := range results {
+		s = append(s, resultString(r.Result))
+	}
+	return strings.Join(s, " ")
+}
+
+// write writes the plan items of p to w
+func (c *csvWriter) write(w io.Writer, p *plan) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"id",
+		"protocol",
+		"src_ip",
+		"dst_ip",
+		"src_port",
+		"dst_port",
+		"result",
+		"expected",
+		"sender_results",
+		"receiver_results",
+		"packet_diffs",
+		"reason",
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range p.getResultItems() {
+		result := item.getResult()
+		diffs := []string{}
+		for _, d := range item.PacketDiffs {
+			diffs = append(diffs, d.String())
+		}
+		err := cw.Write([]string{
+			fmt.Sprintf("%d", item.ID),
+			protocolString(item.SenderMsg.Protocol),
+			fmt.Sprintf("%s", item.SenderMsg.SrcIP),
+			fmt.Sprintf("%s", item.SenderMsg.DstIP),
+			fmt.Sprintf("%d", item.SenderMsg.SrcPort),
+			fmt.Sprintf("%d", item.SenderMsg.DstPort),
+			planResultString(result),
+			item.Expected,
+			c.getResultsString(item.SenderResults),
+			c.getResultsString(item.ReceiverResults),
+			strings.Join(diffs, "; "),
+			item.getReason(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// jsonRange is a port range with the same result in the json summary
+type jsonRange struct {
+	Flow     string `json:"flow"`
+	Ports    string `json:"ports"`
+	Result   string `json:"result"`
+	Reason   string `json:"reason,omitempty"`
+	Expected string `json:"expected,omitempty"`
+}
+
+// jsonPacketDiff is a packet difference in the json summary
+type jsonPacketDiff struct {
+	Flow     string `json:"flow"`
+	Port     uint16 `json:"port"`
+	Field    string `json:"field"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+}
+
+// jsonRejectSource is a port range with the same reject sources in the json
+// summary
+type jsonRejectSource struct {
+	Flow    string `json:"flow"`
+	Ports   string `json:"ports"`
+	Sources string `json:"sources"`
+}
+
+// jsonSummary is a summary of the results of a plan in json
+type jsonSummary struct {
+	Items         int                 `json:"items"`
+	Results       []*jsonRange        `json:"results"`
+	Mismatches    []*jsonRange        `json:"mismatches,omitempty"`
+	PacketDiffs   []*jsonPacketDiff   `json:"packet_diffs,omitempty"`
+	RejectSources []*jsonRejectSource `json:"reject_sources,omitempty"`
+}
+
+// jsonWriter writes a summary of result ranges, packet differences and reject
+// sources as json
+type jsonWriter struct{}
+
+// write writes the summary of the results of p to w
+func (j *jsonWriter) write(w io.Writer, p *plan) error {
+	summary := &jsonSummary{
+		Items:   len(p.getResultItems()),
+		Results: []*jsonRange{},
+	}
+	for _, r := range p.getResults().ranges {
+		summary.Results = append(summary.Results, &jsonRange{
+			Flow:   r.flow,
+			Ports:  portRangeString(r.firstPort, r.lastPort),
+			Result: planResultString(r.result),
+			Reason: r.reason,
+		})
+	}
+	for _, r := range p.getMismatches().ranges {
+		summary.Mismatches = append(summary.Mismatches, &jsonRange{
+			Flow:     r.flow,
+			Ports:    portRangeString(r.firstPort, r.lastPort),
+			Result:   planResultString(r.after),
+			Expected: planResultString(r.before),
+		})
+	}
+	for _, item := range p.getResultItems() {
+		for _, d := range item.PacketDiffs {
+			summary.PacketDiffs = append(summary.PacketDiffs,
+				&jsonPacketDiff{
+					Flow:     item.getFlow(),
+					Port:     item.Port,
+					Field:    d.Field,
+					Sender:   d.Sender,
+					Receiver: d.Receiver,
+				})
+		}
+	}
+	for _, r := range p.getRejectSources().ranges {
+		summary.RejectSources = append(summary.RejectSources, &jsonRejectSource{
+			Flow:    r.flow,
+			Ports:   portRangeString(r.firstPort, r.lastPort),
+			Sources: r.result,
+		})
+	}
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	return e.Encode(summary)
+}
+
+// junitFailure is a failure of a junit test case
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// junitTestCase is a junit test case
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+// junitTestSuite is a junit test suite
+type junitTestSuite struct {
+	XMLName   xml.Name         `xml:"testsuite"`
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	TestCases []*junitTestCase `xml:"testcase"`
+}
+
+// junitWriter writes one junit test case per expected result range or, if
+// there are no expected results, per result range as junit xml
+type junitWriter struct{}
+
+// write writes the results of p to w
+func (j *junitWriter) write(w io.Writer, p *plan) error {
+	suite := &junitTestSuite{Name: "middleboxer"}
+
+	// add test cases for expected results
+	for _, r := range p.getExpectations().ranges {
+		tc := &junitTestCase{
+			Name: fmt.Sprintf("%s expect %s",
+				portRangeString(r.firstPort, r.lastPort),
+				planResultString(r.before)),
+			ClassName: r.flow,
+		}
+		if r.before != r.after {
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("expected %s, got %s",
+					planResultString(r.before),
+					planResultString(r.after)),
+				Type: "mismatch",
+			}
+			suite.Failures++
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	// without expected results, add test cases for results
+	if len(suite.TestCases) == 0 {
+		for _, r := range p.getResults().ranges {
+			suite.TestCases = append(suite.TestCases, &junitTestCase{
+				Name:      portRangeString(r.firstPort, r.lastPort),
+				ClassName: r.flow,
+				SystemOut: r.verdict(),
+			})
+		}
+	}
+	suite.Tests = len(suite.TestCases)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "    ")
+	if err := e.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
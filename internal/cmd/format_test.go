@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// getExampleResultWriterPlan is a init helper for the result writer examples
+func getExampleResultWriterPlan() *plan {
+	config := NewConfig()
+	config.SenderSrcIP = "192.168.1.1"
+	config.SenderDstIP = "192.168.1.2"
+	config.PortRange = "1024:1026"
+	config.Expect = "1024=pass,*=drop"
+	plan := newPlan(config)
+	plan.items[0].ReceiverResults = []*MessageResult{{Result: ResultPass}}
+	plan.items[0].PacketDiffs.add("SrcPort", "0", "4242")
+	plan.items[2].SenderResults = []*MessageResult{{Result: ResultTCPReset}}
+	return plan
+}
+
+// Example_csvWriter runs the csv result writer
+func Example_csvWriter() {
+	plan := getExampleResultWriterPlan()
+	_ = resultWriters["csv"].write(os.Stdout, plan)
+
+	// Output:
+	// id,protocol,src_ip,dst_ip,src_port,dst_port,result,expected,sender_results,receiver_results,packet_diffs,reason
+	// 0,tcp,192.168.1.1,192.168.1.2,0,1024,pass,pass,,pass,SrcPort: 0 -> 4242,
+	// 1,tcp,192.168.1.1,192.168.1.2,0,1025,drop,drop,,,,
+	// 2,tcp,192.168.1.1,192.168.1.2,0,1026,reject,drop,tcp-reset,,,tcp-reset
+}
+
+// Example_jsonWriter runs the json result writer
+func Example_jsonWriter() {
+	plan := getExampleResultWriterPlan()
+	_ = resultWriters["json"].write(os.Stdout, plan)
+
+	// Output:
+	// {"items":3,"results":[{"flow":"tcp 192.168.1.1 -> 192.168.1.2","ports":"1024","result":"pass"},{"flow":"tcp 192.168.1.1 -> 192.168.1.2","ports":"1025","result":"drop"},{"flow":"tcp 192.168.1.1 -> 192.168.1.2","ports":"1026","result":"reject","reason":"tcp-reset"}],"mismatches":[{"flow":"tcp 192.168.1.1 -> 192.168.1.2","ports":"1026","result":"reject","expected":"drop"}],"packet_diffs":[{"flow":"tcp 192.168.1.1 -> 192.168.1.2","port":1024,"field":"SrcPort","sender":"0","receiver":"4242"}]}
+}
+
+// Example_junitWriter runs the junit result writer
+func Example_junitWriter() {
+	plan := getExampleResultWriterPlan()
+	_ = resultWriters["junit"].write(os.Stdout, plan)
+
+	// Output:
+	// <?xml version="1.0" encoding="UTF-8"?>
+	// <testsuite name="middleboxer" tests="3" failures="1">
+	//     <testcase name="1024 expect pass" classname="tcp 192.168.1.1 -&gt; 192.168.1.2"></testcase>
+	//     <testcase name="1025 expect drop" classname="tcp 192.168.1.1 -&gt; 192.168.1.2"></testcase>
+	//     <testcase name="1026 expect drop" classname="tcp 192.168.1.1 -&gt; 192.168.1.2">
+	//         <failure message="expected drop, got reject" type="mismatch"></failure>
+	//     </testcase>
+	// </testsuite>
+}
+
+// TestHTMLWriter tests the html result writer
+func TestHTMLWriter(t *testing.T) {
+	plan := getExampleResultWriterPlan()
+	plan.items[0].ReceiverResults[0].Packet = []byte{
+		0x0a, 0xbc, 0xde, 0xf0, 0x00, 0x22,
+		0x0a, 0xbc, 0xde, 0xf0, 0x00, 0x12,
+		0x08, 0x00,
+	}
+	var buf bytes.Buffer
+	if err := resultWriters["html"].write(&buf, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		"<td>pass=1 reject=1 drop=1 pass&#43;reject=0 error=0 unknown=0 </td>",
+		"<tr><td>1</td><td>sender</td><td></td></tr>",
+		"<h3>tcp 192.168.1.1 -&gt; 192.168.1.2</h3>",
+		"<tr><td>1026</td><td class=\"reject\">reject: tcp-reset</td></tr>",
+		"<span class=\"drop\" title=\"1025: drop\"></span>",
+		"<td>1026</td><td>drop</td><td class=\"reject\">reject</td>",
+		"<td>1024</td><td>SrcPort</td><td>0</td><td>4242</td>",
+		"(expected drop)",
+		"DstMAC=0a:bc:de:f0:00:22",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
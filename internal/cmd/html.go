@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// htmlTemplate is the template of the html report
+var htmlTemplate = template.Must(template.New("report").Funcs(
+	template.FuncMap{"join": strings.Join}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>middleboxer report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+.heatmap { display: flex; flex-wrap: wrap; max-width: 64em; }
+.heatmap span { width: 0.8em; height: 0.8em; margin: 1px; }
+.pass { background: #4caf50; }
+.reject { background: #ff9800; }
+.drop { background: #f44336; }
+.pass\+reject { background: #ffeb3b; }
+.error { background: #9c27b0; }
+.unknown, .missing { background: #9e9e9e; }
+</style>
+</head>
+<body>
+<h1>middleboxer report</h1>
+
+<h2>Run</h2>
+<table>
+<tr><th>Plan items</th><td>{{.Items}}</td></tr>
+<tr><th>Results</th><td>{{range .Counts}}{{.Result}}={{.Count}} {{end}}</td></tr>
+<tr><th>First probe</th><td>{{.Started}}</td></tr>
+<tr><th>Last probe</th><td>{{.Finished}}</td></tr>
+<tr><th>Duration</th><td>{{.Duration}}</td></tr>
+</table>
+<table>
+<tr><th>Client</th><th>Role</th><th>Interfaces</th></tr>
+{{range .Clients}}<tr><td>{{.ID}}</td><td>{{.Role}}</td><td>{{join .Devices ", "}}</td></tr>
+{{end}}</table>
+
+<h2>Results</h2>
+{{range .Flows}}<h3>{{.Flow}}</h3>
+<table>
+<tr><th>Ports</th><th>Result</th></tr>
+{{range .Ranges}}<tr><td>{{.Ports}}</td><td class="{{.Result}}">{{.Result}}{{if .Reason}}: {{.Reason}}{{end}}</td></tr>
+{{end}}</table>
+<div class="heatmap">{{range .Ports}}<span class="{{.Result}}" title="{{.Port}}: {{.Result}}"></span>{{end}}</div>
+{{end}}
+{{if .Mismatches}}<h2>Mismatches</h2>
+<table>
+<tr><th>Flow</th><th>Ports</th><th>Expected</th><th>Result</th></tr>
+{{range .Mismatches}}<tr><td>{{.Flow}}</td><td>{{.Ports}}</td><td>{{.Expected}}</td><td class="{{.Result}}">{{.Result}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .PacketDiffs}}<h2>Packet Differences</h2>
+<table>
+<tr><th>Flow</th><th>Port</th><th>Field</th><th>Sender</th><th>Receiver</th></tr>
+{{range .PacketDiffs}}<tr><td>{{.Flow}}</td><td>{{.Port}}</td><td>{{.Field}}</td><td>{{.Sender}}</td><td>{{.Receiver}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Plan Items</h2>
+{{range .PlanItems}}<details>
+<summary>Item {{.ID}}: {{.Flow}} port {{.Port}}: <span class="{{.Result}}">{{.Result}}</span>{{if .Reason}}: {{.Reason}}{{end}}{{if .Expected}} (expected {{.Expected}}){{end}}</summary>
+<p>Sender {{.SenderID}}, receiver {{.ReceiverID}}, sent at {{.SendTime}}</p>
+{{if .Rejects}}<p>Reject sources: {{.Rejects}}</p>
+{{end}}{{range .Packets}}<p>{{.Side}}: {{.Result}} at {{.Time}}</p>
+<pre>{{.Dump}}</pre>
+{{end}}</details>
+{{end}}
+</body>
+</html>
+`))
+
+// htmlCount is the number of plan items with a result in the html report
+type htmlCount struct {
+	Result string
+	Count  int
+}
+
+// htmlClient is a client in the html report
+type htmlClient struct {
+	ID      uint8
+	Role    string
+	Devices []string
+}
+
+// htmlPort is the result of a port in the heatmap of the html report
+type htmlPort struct {
+	Port   uint16
+	Result string
+}
+
+// htmlFlow contains the result ranges and the heatmap of a flow in the html
+// report
+type htmlFlow struct {
+	Flow   string
+	Ranges []*jsonRange
+	Ports  []*htmlPort
+}
+
+// htmlPacket is a packet of a result in the html report
+type htmlPacket struct {
+	Side   string
+	Result string
+	Time   time.Time
+	Dump   string
+}
+
+// htmlItem is a plan item in the html report
+type htmlItem struct {
+	ID         uint32
+	Flow       string
+	Port       uint16
+	Result     string
+	Reason     string
+	Expected   string
+	Rejects    string
+	SenderID   uint8
+	ReceiverID uint8
+	SendTime   time.Time
+	Packets    []*htmlPacket
+}
+
+// htmlReport contains all data of the html report
+type htmlReport struct {
+	Items       int
+	Counts      []*htmlCount
+	Started     time.Time
+	Finished    time.Time
+	Duration    time.Duration
+	Clients     []*htmlClient
+	Flows       []*htmlFlow
+	Mismatches  []*jsonRange
+	PacketDiffs []*jsonPacketDiff
+	PlanItems   []*htmlItem
+}
+
+// htmlWriter writes a self-contained html report
+type htmlWriter struct{}
+
+// addClient adds the client with id, role and device to the report
+func (h *htmlWriter) addClient(report *htmlReport, id uint8, role,
+	device string) {
+	for _, c := range report.Clients {
+		if c.ID == id && c.Role == role {
+			if !slices.Contains(c.Devices, device) {
+				c.Devices = append(c.Devices, device)
+			}
+			return
+		}
+	}
+	report.Clients = append(report.Clients, &htmlClient{
+		ID:      id,
+		Role:    role,
+		Devices: []string{device},
+	})
+}
+
+// getPackets returns the decoded packets in results of side
+func (h *htmlWriter) getPackets(side string,
+	results []*MessageResult) []*htmlPacket {
+	packets := []*htmlPacket{}
+	for _, r := range results {
+		if r.Packet == nil {
+			continue
+		}
+		pkt := gopacket.NewPacket(r.Packet, layers.LayerTypeEthernet,
+			gopacket.Default)
+		packets = append(packets, &htmlPacket{
+			Side:   side,
+			Result: resultString(r.Result),
+			Time:   r.Time,
+			Dump:   pkt.String(),
+		})
+	}
+	return packets
+}
+
+// write writes the html report of p to w
+func (h *htmlWriter) write(w io.Writer, p *plan) error {
+	items := p.getResultItems()
+	report := &htmlReport{Items: len(items)}
+	counts := make(map[uint8]int)
+	flows := make(map[string]*htmlFlow)
+	for _, item := range items {
+		result := item.getResult()
+		counts[result]++
+
+		// timing
+		if !item.SendTime.IsZero() {
+			if report.Started.IsZero() ||
+				item.SendTime.Before(report.Started) {
+				report.Started = item.SendTime
+			}
+			if item.SendTime.After(report.Finished) {
+				report.Finished = item.SendTime
+			}
+		}
+
+		// clients
+		h.addClient(report, item.SenderID, "sender",
+			item.SenderMsg.Device)
+		for _, hop := range item.Hops {
+			h.addClient(report, hop.ReceiverID, "hop",
+				hop.ReceiverMsg.Device)
+		}
+		if item.ReceiverMsg != nil {
+			h.addClient(report, item.ReceiverID, "receiver",
+				item.ReceiverMsg.Device)
+		}
+
+		// heatmap
+		flow := flows[item.getFlow()]
+		if flow == nil {
+			flow = &htmlFlow{Flow: item.getFlow()}
+			flows[flow.Flow] = flow
+			report.Flows = append(report.Flows, flow)
+		}
+		flow.Ports = append(flow.Ports, &htmlPort{
+			Port:   item.Port,
+			Result: planResultString(result),
+		})
+
+		// drill-down
+		hi := &htmlItem{
+			ID:         item.ID,
+			Flow:       item.getFlow(),
+			Port:       item.Port,
+			Result:     planResultString(result),
+			Reason:     item.getReason(),
+			Rejects:    item.getRejectSources(),
+			Expected:   item.Expected,
+			SenderID:   item.SenderID,
+			ReceiverID: item.ReceiverID,
+			SendTime:   item.SendTime,
+		}
+		hi.Packets = append(hi.Packets,
+			h.getPackets("sender", item.SenderResults)...)
+		for _, hop := range item.Hops {
+			hi.Packets = append(hi.Packets, h.getPackets(
+				fmt.Sprintf("hop %d", hop.ReceiverID),
+				hop.ReceiverResults)...)
+		}
+		hi.Packets = append(hi.Packets,
+			h.getPackets("receiver", item.ReceiverResults)...)
+		report.PlanItems = append(report.PlanItems, hi)
+
+		// packet differences
+		for _, d := range item.PacketDiffs {
+			report.PacketDiffs = append(report.PacketDiffs,
+				&jsonPacketDiff{
+					Flow:     item.getFlow(),
+					Port:     item.Port,
+					Field:    d.Field,
+					Sender:   d.Sender,
+					Receiver: d.Receiver,
+				})
+		}
+	}
+	report.Duration = report.Finished.Sub(report.Started)
+	for _, r := range []uint8{
+		planResultPass,
+		planResultReject,
+		planResultDrop,
+		planResultPassReject,
+		planResultError,
+		planResultUnknown,
+	} {
+		report.Counts = append(report.Counts, &htmlCount{
+			Result: planResultString(r),
+			Count:  counts[r],
+		})
+	}
+
+	// result ranges
+	for _, r := range p.getResults().ranges {
+		flows[r.flow].Ranges = append(flows[r.flow].Ranges, &jsonRange{
+			Flow:   r.flow,
+			Ports:  portRangeString(r.firstPort, r.lastPort),
+			Result: planResultString(r.result),
+			Reason: r.reason,
+		})
+	}
+	for _, r := range p.getMismatches().ranges {
+		report.Mismatches = append(report.Mismatches, &jsonRange{
+			Flow:     r.flow,
+			Ports:    portRangeString(r.firstPort, r.lastPort),
+			Result:   planResultString(r.after),
+			Expected: planResultString(r.before),
+		})
+	}
+
+	return htmlTemplate.Execute(w, report)
+}
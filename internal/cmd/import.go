@@ -0,0 +1,378 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+)
+
+// importPortRange is a port range matched by an imported rule
+type importPortRange struct {
+	first uint16
+	last  uint16
+}
+
+// importRule is a filter rule imported from a firewall ruleset
+type importRule struct {
+	protocol uint16
+	src      []*net.IPNet
+	dst      []*net.IPNet
+	ports    []*importPortRange
+	result   uint8
+}
+
+// matchesAddr checks if ip is in one of the networks; no networks match all
+// ip addresses
+func (r *importRule) matchesAddr(networks []*net.IPNet, ip net.IP) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPort checks if port is in one of the port ranges of the rule; no
+// port ranges match all ports
+func (r *importRule) matchesPort(port uint16) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, p := range r.ports {
+		if port >= p.first && port <= p.last {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks if the rule matches probe
+func (r *importRule) matches(probe *importProbe) bool {
+	if r.protocol != ProtocolNone && r.protocol != probe.protocol {
+		return false
+	}
+	return r.matchesAddr(r.src, probe.src) &&
+		r.matchesAddr(r.dst, probe.dst) &&
+		r.matchesPort(probe.port)
+}
+
+// importRuleset is a filter ruleset imported from a firewall; skipped is the
+// number of rules that cannot be imported and may affect the probes
+type importRuleset struct {
+	rules   []*importRule
+	policy  uint8
+	skipped int
+}
+
+// evaluate returns the result of the first rule matching probe or the
+// policy of the ruleset if no rule matches
+func (r *importRuleset) evaluate(probe *importProbe) uint8 {
+	for _, rule := range r.rules {
+		if rule.matches(probe) {
+			return rule.result
+		}
+	}
+	return r.policy
+}
+
+// importProbe is a probe packet derived from an imported ruleset
+type importProbe struct {
+	protocol uint16
+	src      net.IP
+	dst      net.IP
+	port     uint16
+}
+
+// key returns a string that identifies the probe
+func (p *importProbe) key() string {
+	return fmt.Sprintf("%d %s %s %d", p.protocol, p.src, p.dst, p.port)
+}
+
+// addIP adds n to ip and returns the resulting ip address or nil if the
+// result is not a valid ip address of the same address family
+func addIP(ip net.IP, n int64) net.IP {
+	b := ip.To4()
+	if b == nil {
+		b = ip.To16()
+	}
+	i := new(big.Int).SetBytes(b)
+	i.Add(i, big.NewInt(n))
+	if i.Sign() < 0 || len(i.Bytes()) > len(b) {
+		return nil
+	}
+	r := make(net.IP, len(b))
+	i.FillBytes(r)
+	return r
+}
+
+// getNetworkEdges returns the first and last ip address in network as well
+// as the ip addresses right before and after network
+func getNetworkEdges(network *net.IPNet) []net.IP {
+	first := network.IP.Mask(network.Mask)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^network.Mask[i]
+	}
+
+	edges := []net.IP{first, last}
+	for _, ip := range []net.IP{addIP(first, -1), addIP(last, 1)} {
+		if ip != nil {
+			edges = append(edges, ip)
+		}
+	}
+	return edges
+}
+
+// getPortEdges returns the first and last port in the port range as well as
+// the ports right before and after the port range
+func getPortEdges(ports *importPortRange) []uint16 {
+	edges := []uint16{ports.first, ports.last}
+	if ports.first > 1 {
+		edges = append(edges, ports.first-1)
+	}
+	if ports.last < math.MaxUint16 {
+		edges = append(edges, ports.last+1)
+	}
+	return edges
+}
+
+// importer creates a plan with expected results from an imported ruleset
+type importer struct {
+	config  *Config
+	ruleset *importRuleset
+	probes  map[string]*importProbe
+}
+
+// isSameFamily checks if all networks have the same address family as ip
+func (i *importer) isSameFamily(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if (n.IP.To4() == nil) != (ip.To4() == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// addProbe adds probe to the probes of the importer
+func (i *importer) addProbe(probe *importProbe) {
+	i.probes[probe.key()] = probe
+}
+
+// addRuleProbes adds probes that check the boundaries of rule; rules of
+// another address family cannot match the probes and are ignored
+func (i *importer) addRuleProbes(rule *importRule) {
+	// get base probe that matches the rule
+	src := i.config.GetSenderSrcIP()
+	dst := i.config.GetSenderDstIP()
+	if src == nil || dst == nil {
+		log.Fatal("importing rules requires source and destination IP")
+	}
+	if !i.isSameFamily(rule.src, src) || !i.isSameFamily(rule.dst, dst) {
+		log.Println("Ignoring rule with other address family")
+		return
+	}
+	base := importProbe{
+		protocol: rule.protocol,
+		src:      src,
+		dst:      dst,
+	}
+	if base.protocol == ProtocolNone {
+		base.protocol = i.config.Protocol
+	}
+	if len(rule.src) > 0 {
+		base.src = rule.src[0].IP.Mask(rule.src[0].Mask)
+	}
+	if len(rule.dst) > 0 {
+		base.dst = rule.dst[0].IP.Mask(rule.dst[0].Mask)
+	}
+	base.port, _ = i.config.GetPortRange()
+	if len(rule.ports) > 0 {
+		base.port = rule.ports[0].first
+	}
+	i.addProbe(&base)
+
+	// add probes on the edges of the source networks
+	for _, n := range rule.src {
+		for _, ip := range getNetworkEdges(n) {
+			probe := base
+			probe.src = ip
+			i.addProbe(&probe)
+		}
+	}
+
+	// add probes on the edges of the destination networks; probes right
+	// outside of a network are only added if they are sent to the
+	// receiver's address, the receiver cannot capture other probes
+	for _, n := range rule.dst {
+		for _, ip := range getNetworkEdges(n) {
+			if !n.Contains(ip) && !ip.Equal(dst) {
+				continue
+			}
+			probe := base
+			probe.dst = ip
+			i.addProbe(&probe)
+		}
+	}
+
+	// add probes on the edges of the port ranges
+	for _, r := range rule.ports {
+		for _, port := range getPortEdges(r) {
+			probe := base
+			probe.port = port
+			i.addProbe(&probe)
+		}
+	}
+}
+
+// getSortedProbes returns the probes of the importer sorted by protocol,
+// ip addresses and port
+func (i *importer) getSortedProbes() []*importProbe {
+	probes := []*importProbe{}
+	for _, probe := range i.probes {
+		probes = append(probes, probe)
+	}
+	sort.Slice(probes, func(a, b int) bool {
+		pa, pb := probes[a], probes[b]
+		if pa.protocol != pb.protocol {
+			return pa.protocol < pb.protocol
+		}
+		if c := compareIPs(pa.src, pb.src); c != 0 {
+			return c < 0
+		}
+		if c := compareIPs(pa.dst, pb.dst); c != 0 {
+			return c < 0
+		}
+		return pa.port < pb.port
+	})
+	return probes
+}
+
+// compareIPs compares the ip addresses a and b
+func compareIPs(a, b net.IP) int {
+	a16, b16 := a.To16(), b.To16()
+	for i := range a16 {
+		if a16[i] != b16[i] {
+			return int(a16[i]) - int(b16[i])
+		}
+	}
+	return 0
+}
+
+// newPlanItem creates a plan item for probe
+func (i *importer) newPlanItem(id uint32, probe *importProbe) *planItem {
+	senderMsg := newSenderMessage(id, probe.port, i.config)
+	senderMsg.Protocol = probe.protocol
+	senderMsg.SrcIP = probe.src
+	senderMsg.DstIP = probe.dst
+
+	receiverMsg := newReceiverMessage(id, probe.port, i.config)
+	receiverMsg.Protocol = probe.protocol
+	if !probe.src.Equal(i.config.GetSenderSrcIP()) {
+		receiverMsg.SrcIP = probe.src
+	}
+	if !probe.dst.Equal(i.config.GetSenderDstIP()) {
+		receiverMsg.DstIP = probe.dst
+	}
+
+	item := newPlanItem(id, probe.port, senderMsg, receiverMsg)
+	item.Expected = planResultString(i.ruleset.evaluate(probe))
+	return item
+}
+
+// getPlan returns a plan with probes for all rules and their expected results
+func (i *importer) getPlan() *plan {
+	for _, rule := range i.ruleset.rules {
+		i.addRuleProbes(rule)
+	}
+
+	items := make(map[uint32]*planItem)
+	for id, probe := range i.getSortedProbes() {
+		items[uint32(id)] = i.newPlanItem(uint32(id), probe)
+	}
+	p := &plan{items: items}
+	p.setClients(i.config.SenderID, i.config.ReceiverID)
+	p.schedule()
+	return p
+}
+
+// newImporter creates a new importer for ruleset
+func newImporter(config *Config, ruleset *importRuleset) *importer {
+	return &importer{
+		config:  config,
+		ruleset: ruleset,
+		probes:  make(map[string]*importProbe),
+	}
+}
+
+// importPlan imports the ruleset in the import file of config and writes
+// the resulting plan to the plan file of config
+func importPlan(config *Config) {
+	b, err := os.ReadFile(config.ImportFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ruleset *importRuleset
+	switch config.ImportFormat {
+	case "iptables":
+		ruleset, err = parseIPTables(b, config.ImportChain)
+	case "nft":
+		ruleset, err = parseNFTables(b, config.ImportChain)
+	default:
+		err = fmt.Errorf("unknown import format: %s", config.ImportFormat)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// expected results are incomplete if rules were skipped
+	plan := newImporter(config, ruleset).getPlan()
+	if ruleset.skipped > 0 {
+		if !config.ImportForce {
+			log.Fatalf("Cannot import %d rules, expected results "+
+				"would be incomplete; use -force to import anyway",
+				ruleset.skipped)
+		}
+		log.Printf("Warning: skipped %d rules, expected results may "+
+			"be wrong", ruleset.skipped)
+	}
+	log.Printf("Imported %d rules into plan with %d items",
+		len(ruleset.rules), len(plan.items))
+	plan.writeFile(config.ImportPlanFile, "items")
+}
+
+// parseNetwork parses s as ip network in CIDR notation or as single ip
+// address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseProtocol parses s as protocol name or number
+func parseProtocol(s string) (uint16, error) {
+	switch s {
+	case "tcp", "6":
+		return ProtocolTCP, nil
+	case "udp", "17":
+		return ProtocolUDP, nil
+	}
+	return ProtocolNone, fmt.Errorf("unsupported protocol: %s", s)
+}
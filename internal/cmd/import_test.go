@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"testing"
+)
+
+// testIPTablesRules is an example output of iptables-save
+const testIPTablesRules = `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -p tcp --dport 8080 -j DNAT --to-destination 10.0.0.1:80
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+-A FORWARD -m state --state RELATED,ESTABLISHED -j ACCEPT
+-A FORWARD -d 192.168.1.2/32 -p tcp -m tcp --dport 22 -m comment --comment "allow ssh" -j ACCEPT
+-A FORWARD -p tcp -m multiport --dports 1024:1030 -j REJECT --reject-with tcp-reset
+COMMIT
+`
+
+// testNFTablesRules is an example output of nft -j list ruleset
+const testNFTablesRules = `{"nftables": [
+{"metainfo": {"version": "1.0.9", "json_schema_version": 1}},
+{"table": {"family": "inet", "name": "filter", "handle": 1}},
+{"chain": {"family": "inet", "table": "filter", "name": "forward",
+ "handle": 1, "type": "filter", "hook": "forward", "prio": 0,
+ "policy": "drop"}},
+{"rule": {"family": "inet", "table": "filter", "chain": "forward",
+ "handle": 2, "expr": [
+  {"match": {"op": "in", "left": {"ct": {"key": "state"}},
+   "right": ["established", "related"]}},
+  {"accept": null}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "forward",
+ "handle": 3, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip",
+   "field": "daddr"}}, "right": "192.168.1.2"}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp",
+   "field": "dport"}}, "right": 22}},
+  {"counter": {"packets": 0, "bytes": 0}},
+  {"accept": null}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "forward",
+ "handle": 4, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp",
+   "field": "dport"}}, "right": {"set": [{"range": [1024, 1030]}]}}},
+  {"reject": {"type": "tcp reset"}}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "forward",
+ "handle": 5, "expr": [
+  {"match": {"op": "in", "left": {"ct": {"key": "state"}},
+   "right": ["new", "established"]}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp",
+   "field": "dport"}}, "right": 80}},
+  {"accept": null}]}}
+]}`
+
+// getTestImportConfig returns a config for import tests
+func getTestImportConfig() *Config {
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.SenderSrcIP = "192.168.1.1"
+	config.SenderDstIP = "192.168.1.2"
+	return config
+}
+
+// printTestImportPlan prints the plan items of p
+func printTestImportPlan(p *plan) {
+	for i := uint32(0); i < uint32(len(p.items)); i++ {
+		item := p.items[i]
+		fmt.Println(item.getFlow(), item.Port, item.Expected)
+	}
+}
+
+// Example_parseIPTables runs parseIPTables() and creates a plan
+func Example_parseIPTables() {
+	config := getTestImportConfig()
+	ruleset, err := parseIPTables([]byte(testIPTablesRules), "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	printTestImportPlan(newImporter(config, ruleset).getPlan())
+
+	// Output:
+	// Skipping rule in line 10: does not match new connections
+	// tcp 192.168.1.1 -> 192.168.1.2 21 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 22 pass
+	// tcp 192.168.1.1 -> 192.168.1.2 23 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 1023 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 1024 reject
+	// tcp 192.168.1.1 -> 192.168.1.2 1030 reject
+	// tcp 192.168.1.1 -> 192.168.1.2 1031 drop
+}
+
+// Example_parseNFTables runs parseNFTables() and creates a plan
+func Example_parseNFTables() {
+	config := getTestImportConfig()
+	ruleset, err := parseNFTables([]byte(testNFTablesRules), "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	printTestImportPlan(newImporter(config, ruleset).getPlan())
+
+	// Output:
+	// Skipping rule 2: does not match new connections
+	// tcp 192.168.1.1 -> 192.168.1.2 21 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 22 pass
+	// tcp 192.168.1.1 -> 192.168.1.2 23 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 79 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 80 pass
+	// tcp 192.168.1.1 -> 192.168.1.2 81 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 1023 drop
+	// tcp 192.168.1.1 -> 192.168.1.2 1024 reject
+	// tcp 192.168.1.1 -> 192.168.1.2 1030 reject
+	// tcp 192.168.1.1 -> 192.168.1.2 1031 drop
+}
+
+// TestGetNetworkEdges tests getting the edges of networks
+func TestGetNetworkEdges(t *testing.T) {
+	test := func(network string, want string) {
+		n, err := parseNetwork(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := fmt.Sprint(getNetworkEdges(n))
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	test("10.0.0.0/8", "[10.0.0.0 10.255.255.255 9.255.255.255 11.0.0.0]")
+	test("192.168.1.1", "[192.168.1.1 192.168.1.1 192.168.1.0 192.168.1.2]")
+	test("0.0.0.0/0", "[0.0.0.0 255.255.255.255]")
+	test("2001:db8::/64",
+		"[2001:db8:: 2001:db8::ffff:ffff:ffff:ffff "+
+			"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff 2001:db8:0:1::]")
+}
+
+// TestImportSkippedRules tests counting rules that cannot be imported
+func TestImportSkippedRules(t *testing.T) {
+	config := getTestImportConfig()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// negation; rules of other address family are ignored
+	ruleset, err := parseIPTables([]byte(`*filter
+:FORWARD DROP [0:0]
+-A FORWARD ! -s 10.0.0.0/8 -j ACCEPT
+-A FORWARD -s 2001:db8::/32 -j ACCEPT
+-A FORWARD -m state --state ESTABLISHED -j ACCEPT
+-A FORWARD -p tcp --dport 22 -j ACCEPT
+COMMIT
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newImporter(config, ruleset).getPlan()
+	if ruleset.skipped != 1 {
+		t.Errorf("got %d skipped rules, want 1", ruleset.skipped)
+	}
+
+	// unsupported operator
+	ruleset, err = parseNFTables([]byte(`{"nftables": [
+{"chain": {"family": "inet", "table": "filter", "name": "forward",
+ "handle": 1, "type": "filter", "hook": "forward", "prio": 0,
+ "policy": "drop"}},
+{"rule": {"family": "inet", "table": "filter", "chain": "forward",
+ "handle": 2, "expr": [
+  {"match": {"op": "!=", "left": {"payload": {"protocol": "tcp",
+   "field": "dport"}}, "right": 22}},
+  {"accept": null}]}}
+]}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newImporter(config, ruleset).getPlan()
+	if ruleset.skipped != 1 {
+		t.Errorf("got %d skipped rules, want 1", ruleset.skipped)
+	}
+}
+
+// TestImportDestinationEdges tests adding probes right outside of the
+// destination networks of rules only if the receiver captures them
+func TestImportDestinationEdges(t *testing.T) {
+	config := getTestImportConfig()
+	ruleset, err := parseIPTables([]byte(`*filter
+:FORWARD DROP [0:0]
+-A FORWARD -d 192.168.1.0/31 -p tcp --dport 22 -j ACCEPT
+COMMIT
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newImporter(config, ruleset).getPlan()
+	dsts := []string{}
+	for i := uint32(0); p.items[i] != nil; i++ {
+		dst := p.items[i].SenderMsg.DstIP.String()
+		if !slices.Contains(dsts, dst) {
+			dsts = append(dsts, dst)
+		}
+	}
+	want := []string{"192.168.1.0", "192.168.1.1", "192.168.1.2"}
+	if !slices.Equal(dsts, want) {
+		t.Errorf("got %v, want %v", dsts, want)
+	}
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// splitIPTablesLine splits an iptables-save line into its arguments,
+// respecting double quotes
+func splitIPTablesLine(line string) []string {
+	args := []string{}
+	arg := ""
+	quoted := false
+	inArg := false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg)
+			}
+			arg = ""
+			inArg = false
+		default:
+			arg += string(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg)
+	}
+	return args
+}
+
+// parseIPTablesTarget parses the target of an iptables rule as plan result
+func parseIPTablesTarget(target string) (uint8, error) {
+	switch target {
+	case "ACCEPT":
+		return planResultPass, nil
+	case "REJECT":
+		return planResultReject, nil
+	case "DROP":
+		return planResultDrop, nil
+	}
+	return 0, fmt.Errorf("unsupported target: %s", target)
+}
+
+// parseIPTablesPorts parses a comma separated list of ports and port ranges
+// of an iptables rule
+func parseIPTablesPorts(s string) ([]*importPortRange, error) {
+	ports := []*importPortRange{}
+	for _, p := range strings.Split(s, ",") {
+		first, last := parsePortRange(p)
+		if first == 0 && last == 0 {
+			return nil, fmt.Errorf("invalid ports: %s", s)
+		}
+		ports = append(ports, &importPortRange{first, last})
+	}
+	return ports, nil
+}
+
+// parseIPTablesRule parses the arguments of an iptables rule
+func parseIPTablesRule(args []string) (*importRule, error) {
+	rule := &importRule{}
+	target := ""
+	for i := 0; i < len(args); i++ {
+		// handle options without value
+		opt := args[i]
+		switch opt {
+		case "!":
+			return nil, fmt.Errorf("unsupported negation")
+		case "--syn":
+			// tcp probes are syn packets
+			continue
+		}
+
+		// all remaining options require a value
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value of option %s", opt)
+		}
+		i++
+		val := args[i]
+
+		var err error
+		switch opt {
+		case "-A", "--append":
+			// chain is checked by caller
+		case "-m", "--match":
+			// match extensions are handled by their options
+		case "-i", "--in-interface", "-o", "--out-interface":
+			// interfaces are defined by the test setup
+		case "--comment", "--reject-with":
+			// ignore comments and reject types
+		case "-p", "--protocol":
+			rule.protocol, err = parseProtocol(val)
+		case "-s", "--source":
+			for _, s := range strings.Split(val, ",") {
+				n, err := parseNetwork(s)
+				if err != nil {
+					return nil, err
+				}
+				rule.src = append(rule.src, n)
+			}
+		case "-d", "--destination":
+			for _, s := range strings.Split(val, ",") {
+				n, err := parseNetwork(s)
+				if err != nil {
+					return nil, err
+				}
+				rule.dst = append(rule.dst, n)
+			}
+		case "--dport", "--destination-port",
+			"--dports", "--destination-ports":
+			rule.ports, err = parseIPTablesPorts(val)
+		case "--state", "--ctstate":
+			// probes only create new connections
+			if !strings.Contains(val, "NEW") {
+				return nil, nil
+			}
+		case "-j", "--jump":
+			target = val
+		default:
+			return nil, fmt.Errorf("unsupported option: %s", opt)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// get result from target
+	result, err := parseIPTablesTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	rule.result = result
+	return rule, nil
+}
+
+// parseIPTables parses the filter rules of chain in the output of
+// iptables-save; an empty chain defaults to the FORWARD chain
+func parseIPTables(b []byte, chain string) (*importRuleset, error) {
+	if chain == "" {
+		chain = "FORWARD"
+	}
+	ruleset := &importRuleset{policy: planResultPass}
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		args := splitIPTablesLine(line)
+		switch {
+		case len(args) == 0 || strings.HasPrefix(args[0], "#"):
+			// skip empty lines and comments
+
+		case strings.HasPrefix(args[0], "*"):
+			// table
+			table = args[0][1:]
+
+		case table != "filter":
+			// skip other tables than filter table
+
+		case args[0] == ":"+chain:
+			// chain policy
+			if len(args) < 2 {
+				return nil, fmt.Errorf("line %d: missing policy", n)
+			}
+			policy, err := parseIPTablesTarget(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			ruleset.policy = policy
+
+		case args[0] == "-A" && len(args) > 1 && args[1] == chain:
+			// rule in chain
+			rule, err := parseIPTablesRule(args)
+			if err != nil {
+				log.Printf("Skipping rule in line %d: %s", n, err)
+				ruleset.skipped++
+				continue
+			}
+			if rule == nil {
+				log.Printf("Skipping rule in line %d: "+
+					"does not match new connections", n)
+				continue
+			}
+			ruleset.rules = append(ruleset.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ruleset, nil
+}
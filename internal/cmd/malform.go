@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"net"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// Malformations of test packets
+const (
+	MalformBadIPChecksum   = "bad-ip-checksum"
+	MalformBadL4Checksum   = "bad-l4-checksum"
+	MalformBadIPLength     = "bad-ip-length"
+	MalformLand            = "land"
+	MalformBroadcastSource = "broadcast-source"
+	MalformMulticastSource = "multicast-source"
+	MalformBogonSource     = "bogon-source"
+	MalformReservedFlags   = "reserved-flags"
+	MalformTCPDataOffset   = "tcp-data-offset"
+	MalformUDPZeroLength   = "udp-zero-length"
+)
+
+// malforms is the catalog of all malformations of test packets
+var malforms = []string{
+	MalformBadIPChecksum,
+	MalformBadL4Checksum,
+	MalformBadIPLength,
+	MalformLand,
+	MalformBroadcastSource,
+	MalformMulticastSource,
+	MalformBogonSource,
+	MalformReservedFlags,
+	MalformTCPDataOffset,
+	MalformUDPZeroLength,
+}
+
+// bogon source addresses of test packets
+var (
+	malformBogonIPv4 = net.IPv4(240, 0, 0, 1)
+	malformBogonIPv6 = net.ParseIP("2001:db8::1")
+)
+
+// malformApplies checks if malform can be applied to the packet of test
+func malformApplies(malform string, test *MessageTest) bool {
+	ipv4 := test.SrcIP.To4() != nil
+	switch malform {
+	case MalformBadIPChecksum, MalformBroadcastSource:
+		// ipv6 has no header checksum and no broadcast addresses
+		return ipv4
+	case MalformReservedFlags:
+		// ipv6 has no reserved flags, use tcp's reserved flags
+		return ipv4 || test.Protocol == ProtocolTCP
+	case MalformTCPDataOffset:
+		return test.Protocol == ProtocolTCP
+	case MalformUDPZeroLength:
+		return test.Protocol == ProtocolUDP
+	}
+	return true
+}
+
+// getMalformSrcIP returns the source ip address of the packet of test; it is
+// spoofed by some malformations
+func getMalformSrcIP(test *MessageTest) net.IP {
+	ipv4 := test.SrcIP.To4() != nil
+	switch test.Malform {
+	case MalformLand:
+		return test.DstIP
+	case MalformBroadcastSource:
+		return net.IPv4bcast
+	case MalformMulticastSource:
+		if ipv4 {
+			return net.IPv4allsys
+		}
+		return net.IPv6linklocalallnodes
+	case MalformBogonSource:
+		if ipv4 {
+			return malformBogonIPv4
+		}
+		return malformBogonIPv6
+	}
+	return test.SrcIP
+}
+
+// getMalformSrcPort returns the source port of the packet of test; it is
+// spoofed by some malformations
+func getMalformSrcPort(test *MessageTest) uint16 {
+	if test.Malform == MalformLand {
+		return test.DstPort
+	}
+	return test.SrcPort
+}
+
+// setMalform sets the malformation of the packet sent in test to the
+// receiving test m; spoofed addresses are not checked by the receiver
+func (m *MessageTest) setMalform(test *MessageTest) {
+	m.Malform = test.Malform
+	if !getMalformSrcIP(test).Equal(test.SrcIP) {
+		m.SrcIP = nil
+	}
+	if getMalformSrcPort(test) != test.SrcPort {
+		m.SrcPort = 0
+	}
+}
+
+// getBadChecksum returns a checksum that does not match checksum; it avoids
+// the other representation of zero in one's complement
+func getBadChecksum(checksum uint16) uint16 {
+	if checksum == 0xffff {
+		return 1
+	}
+	return checksum + 1
+}
+
+// malformPacket applies the malformation to the serialized layers of the
+// packet; it returns the malformed layer and its serialization options that
+// keep the malformed lengths and checksums
+func (s *senderPacket) malformPacket() (gopacket.SerializableLayer,
+	gopacket.SerializeOptions) {
+	keepLength := gopacket.SerializeOptions{ComputeChecksums: true}
+	keepChecksum := gopacket.SerializeOptions{FixLengths: true}
+	ip, l4 := s.layers[1], gopacket.SerializableLayer(nil)
+	if len(s.layers) > 2 {
+		l4 = s.layers[2]
+	}
+
+	switch s.test.Malform {
+	case MalformBadIPChecksum:
+		if ip, ok := ip.(*layers.IPv4); ok {
+			ip.Checksum = getBadChecksum(ip.Checksum)
+			return ip, keepChecksum
+		}
+	case MalformBadL4Checksum:
+		switch l4 := l4.(type) {
+		case *layers.TCP:
+			l4.Checksum = getBadChecksum(l4.Checksum)
+			return l4, keepChecksum
+		case *layers.UDP:
+			l4.Checksum = getBadChecksum(l4.Checksum)
+			return l4, keepChecksum
+		}
+	case MalformBadIPLength:
+		// claim 8 more bytes than the packet contains
+		switch ip := ip.(type) {
+		case *layers.IPv4:
+			ip.Length += 8
+			return ip, keepLength
+		case *layers.IPv6:
+			ip.Length += 8
+			return ip, keepLength
+		}
+	case MalformTCPDataOffset:
+		// claim the maximum header length of 60 bytes
+		if l4, ok := l4.(*layers.TCP); ok {
+			l4.DataOffset = 15
+			return l4, keepLength
+		}
+	case MalformUDPZeroLength:
+		if l4, ok := l4.(*layers.UDP); ok {
+			l4.Length = 0
+			return l4, keepLength
+		}
+	}
+	return nil, gopacket.SerializeOptions{}
+}
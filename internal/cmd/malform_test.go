@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// TestMalformPackets tests creating malformed packets in the sender and
+// receiving them in the receiver
+func TestMalformPackets(t *testing.T) {
+	newTest := func(protocol uint16, src, dst string,
+		malform string) *MessageTest {
+		return &MessageTest{
+			ID:       42,
+			Initiate: true,
+			SrcMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			SrcIP:    net.ParseIP(src),
+			DstIP:    net.ParseIP(dst),
+			Protocol: protocol,
+			SrcPort:  4242,
+			DstPort:  1024,
+			Malform:  malform,
+		}
+	}
+	uint16At := func(b []byte, i int) uint16 {
+		return binary.BigEndian.Uint16(b[i:])
+	}
+
+	for i, tc := range []struct {
+		protocol uint16
+		src, dst string
+		malform  string
+
+		// check compares the valid and the malformed packet
+		check func(valid, malformed []byte) bool
+	}{
+		{ProtocolTCP, "10.0.1.1", "10.0.2.2", MalformBadIPChecksum,
+			func(v, m []byte) bool {
+				return uint16At(m, 24) == uint16At(v, 24)+1 &&
+					bytes.Equal(v[34:], m[34:])
+			}},
+		{ProtocolTCP, "10.0.1.1", "10.0.2.2", MalformBadL4Checksum,
+			func(v, m []byte) bool {
+				return uint16At(m, 50) == uint16At(v, 50)+1
+			}},
+		{ProtocolUDP, "fd00:1::1", "fd00:2::2", MalformBadL4Checksum,
+			func(v, m []byte) bool {
+				return uint16At(m, 60) == uint16At(v, 60)+1
+			}},
+		{ProtocolUDP, "10.0.1.1", "10.0.2.2", MalformBadIPLength,
+			func(v, m []byte) bool {
+				return uint16At(m, 16) == uint16At(v, 16)+8 &&
+					len(m) == len(v)
+			}},
+		{ProtocolTCP, "fd00:1::1", "fd00:2::2", MalformBadIPLength,
+			func(v, m []byte) bool {
+				return uint16At(m, 18) == uint16At(v, 18)+8 &&
+					len(m) == len(v)
+			}},
+		{ProtocolTCP, "10.0.1.1", "10.0.2.2", MalformLand,
+			func(v, m []byte) bool {
+				return bytes.Equal(m[26:30], m[30:34]) &&
+					uint16At(m, 34) == uint16At(m, 36)
+			}},
+		{ProtocolUDP, "10.0.1.1", "10.0.2.2", MalformBroadcastSource,
+			func(v, m []byte) bool {
+				return bytes.Equal(m[26:30], []byte{255, 255, 255, 255})
+			}},
+		{ProtocolUDP, "fd00:1::1", "fd00:2::2", MalformMulticastSource,
+			func(v, m []byte) bool {
+				return net.IP(m[22:38]).Equal(net.ParseIP("ff02::1"))
+			}},
+		{ProtocolTCP, "10.0.1.1", "10.0.2.2", MalformBogonSource,
+			func(v, m []byte) bool {
+				return bytes.Equal(m[26:30], []byte{240, 0, 0, 1})
+			}},
+		{ProtocolTCP, "10.0.1.1", "10.0.2.2", MalformReservedFlags,
+			func(v, m []byte) bool {
+				return m[20]&0x80 != 0 && m[46]&0x01 != 0
+			}},
+		{ProtocolTCP, "10.0.1.1", "10.0.2.2", MalformTCPDataOffset,
+			func(v, m []byte) bool {
+				return m[46]>>4 == 15 && len(m) == len(v)
+			}},
+		{ProtocolUDP, "10.0.1.1", "10.0.2.2", MalformUDPZeroLength,
+			func(v, m []byte) bool {
+				return uint16At(m, 38) == 0 && uint16At(v, 38) == 12
+			}},
+	} {
+		test := newTest(tc.protocol, tc.src, tc.dst, tc.malform)
+		if !malformApplies(tc.malform, test) {
+			t.Errorf("%d: %s does not apply", i, tc.malform)
+			continue
+		}
+
+		// check malformed packet
+		valid := newSenderPacket(newTest(tc.protocol, tc.src, tc.dst,
+			"")).bytes()
+		malformed := newSenderPacket(test).bytes()
+		if !tc.check(valid, malformed) {
+			t.Errorf("%d: invalid %s packet: %x", i, tc.malform,
+				malformed)
+		}
+
+		// check receiving malformed packet
+		rtest := newTest(tc.protocol, tc.src, tc.dst, "")
+		rtest.Initiate = false
+		rtest.setMalform(test)
+		results := make(chan *MessageResult, 1)
+		r := &receiver{test: rtest, results: results}
+		r.HandlePacket(gopacket.NewPacket(malformed,
+			layers.LayerTypeEthernet, gopacket.Default))
+		select {
+		case result := <-results:
+			if result.Result != ResultPass {
+				t.Errorf("%d: got %s, want pass", i,
+					resultString(result.Result))
+			}
+		default:
+			t.Errorf("%d: %s packet not received", i, tc.malform)
+		}
+	}
+}
+
+// TestMalformReject tests receiving icmp errors for malformed packets with
+// spoofed source addresses and ports in the sender
+func TestMalformReject(t *testing.T) {
+	for i, tc := range []struct {
+		protocol uint16
+		malform  string
+		seq      uint32
+	}{
+		{ProtocolTCP, MalformLand, 1042},
+		{ProtocolTCP, MalformBogonSource, 1042},
+		{ProtocolUDP, MalformLand, 0},
+	} {
+		test := &MessageTest{
+			ID:       42,
+			Initiate: true,
+			SrcMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			SrcIP:    net.ParseIP("10.0.1.1"),
+			DstIP:    net.ParseIP("10.0.2.2"),
+			Protocol: tc.protocol,
+			SrcPort:  4242,
+			DstPort:  1024,
+			Malform:  tc.malform,
+		}
+
+		// quote the ip header and the first 8 bytes of the layer 4
+		// header of the malformed packet; the tcp sequence number
+		// with the test id is rewritten, the udp payload is missing
+		quoted := newSenderPacket(test).bytes()[14:42]
+		if tc.protocol == ProtocolTCP {
+			binary.BigEndian.PutUint32(quoted[24:], tc.seq)
+		}
+		reject := getExampleRejectPacket(
+			&layers.Ethernet{
+				SrcMAC:       test.DstMAC,
+				DstMAC:       test.SrcMAC,
+				EthernetType: layers.EthernetTypeIPv4,
+			},
+			&layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				Protocol: layers.IPProtocolICMPv4,
+				SrcIP:    net.ParseIP("10.0.2.254"),
+				DstIP:    getMalformSrcIP(test),
+			},
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(
+				layers.ICMPv4TypeDestinationUnreachable,
+				layers.ICMPv4CodeCommAdminProhibited)},
+			gopacket.Payload(quoted),
+		)
+
+		results := make(chan *MessageResult, 1)
+		s := &sender{test: test, results: results}
+		s.HandlePacket(gopacket.NewPacket(reject,
+			layers.LayerTypeEthernet, gopacket.Default))
+		select {
+		case r := <-results:
+			if r.Result != ResultICMPv4CommProhibited {
+				t.Errorf("%d: got %s, want %s", i,
+					resultString(r.Result),
+					resultString(ResultICMPv4CommProhibited))
+			}
+		default:
+			t.Errorf("%d: %s reject not received", i, tc.malform)
+		}
+	}
+}
+
+// Example_printResults_malform runs printResults() with malformed probes
+func Example_printResults_malform() {
+	// init
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.PortRange = "1024:1025"
+	config.SenderSrcIP = "10.0.1.1"
+	config.SenderDstIP = "10.0.2.2"
+	config.Malform = "bad-ip-checksum,land,udp-zero-length"
+	plan := newPlan(config)
+
+	// set results
+	for _, item := range plan.items {
+		if item.SenderMsg.Malform == MalformLand {
+			item.ReceiverResults = []*MessageResult{
+				{Result: ResultPass},
+			}
+		}
+	}
+
+	// check output
+	plan.printResults()
+
+	// Output:
+	// Printing results:
+	// tcp 10.0.1.1 -> 10.0.2.2 (bad-ip-checksum)
+	// 1024:1025	drop
+	// tcp 10.0.1.1 -> 10.0.2.2 (land)
+	// 1024:1025	pass
+}
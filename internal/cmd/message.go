@@ -2,19 +2,44 @@ package cmd
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"time"
 )
 
 const (
 	// MessageHeaderLength is the length of the Type and Length fields
-	// of a message
+	// of a legacy message
 	MessageHeaderLength = 3
 
-	// MessageMaxLength is the maximum length of a message in bytes
+	// MessageMaxLength is the maximum length of a legacy message in bytes
 	MessageMaxLength = 4096
+
+	// MessageBinaryHeaderLength is the length of the Type, Flags and
+	// Length fields of a binary message
+	MessageBinaryHeaderLength = 6
+
+	// MessageBinaryMaxLength is the maximum length of a binary message
+	// in bytes, also after decompression
+	MessageBinaryMaxLength = 16 * 1024 * 1024
+
+	// MessageCompressLength is the minimum data length of a binary
+	// message that is compressed
+	MessageCompressLength = 1024
+)
+
+// Message flags: the binary flag is set in the Type field of binary messages
+// to distinguish them from legacy messages, the compressed flag is set in the
+// Flags field of binary messages with compressed data
+const (
+	MessageFlagBinary     = 0x80
+	MessageFlagCompressed = 0x01
 )
 
 // Message types
@@ -24,12 +49,40 @@ const (
 	MessageTypeRegister
 	MessageTypeTest
 	MessageTypeResult
+	MessageTypeRegisterReply
+	MessageTypeError
 	MessageTypeInvalid
 )
 
+// Message errors
+var (
+	// ErrUnknownType is returned when reading a message with an unknown
+	// message type
+	ErrUnknownType = errors.New("unknown message type")
+
+	// ErrTooLong is returned when reading or writing a message that
+	// exceeds the maximum message length
+	ErrTooLong = errors.New("message too long")
+
+	// ErrDecode is returned when reading a message that cannot be decoded
+	ErrDecode = errors.New("cannot decode message")
+)
+
+const (
+	// ProtocolVersion is the version of the protocol between server and
+	// clients
+	ProtocolVersion = 2
+
+	// ProtocolVersionLegacy is the version of the protocol of clients
+	// that use the legacy message format
+	ProtocolVersionLegacy = 1
+)
+
 // Message is an interface for all messages
 type Message interface {
 	GetType() uint8
+	encode(e *messageEncoder)
+	decode(d *messageDecoder)
 }
 
 // MessageNop is a no operation message
@@ -40,9 +93,23 @@ func (m *MessageNop) GetType() uint8 {
 	return MessageTypeNop
 }
 
+// MessageInterface is a network interface of a client
+type MessageInterface struct {
+	Name string
+	MAC  net.HardwareAddr
+	IPs  []net.IP
+}
+
 // MessageRegister is a register message
 type MessageRegister struct {
-	Client uint8
+	Client     uint8
+	Token      string
+	Version    uint16
+	Software   string
+	Protocols  []uint16
+	Features   []string
+	Interfaces []*MessageInterface
+	Session    string
 }
 
 // GetType returns the type of the message
@@ -50,6 +117,60 @@ func (m *MessageRegister) GetType() uint8 {
 	return MessageTypeRegister
 }
 
+// hasProtocol checks if the client supports protocol
+func (m *MessageRegister) hasProtocol(protocol uint16) bool {
+	for _, p := range m.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFeature checks if the client supports feature
+func (m *MessageRegister) hasFeature(feature string) bool {
+	for _, f := range m.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// getInterface returns the client's network interface with name
+func (m *MessageRegister) getInterface(name string) *MessageInterface {
+	for _, i := range m.Interfaces {
+		if i.Name == name {
+			return i
+		}
+	}
+	return nil
+}
+
+// MessageRegisterReply is a reply to a register message
+type MessageRegisterReply struct {
+	Accepted bool
+	Version  uint16
+	Reason   string
+	Session  string
+}
+
+// GetType returns the type of the message
+func (m *MessageRegisterReply) GetType() uint8 {
+	return MessageTypeRegisterReply
+}
+
+// MessageError is an error message that reports a protocol violation to the
+// peer before the connection is closed
+type MessageError struct {
+	Reason string
+}
+
+// GetType returns the type of the message
+func (m *MessageError) GetType() uint8 {
+	return MessageTypeError
+}
+
 // Protocol types
 const (
 	ProtocolNone = 0
@@ -57,6 +178,17 @@ const (
 	ProtocolUDP  = 17
 )
 
+// protocolString converts a protocol number to a string
+func protocolString(protocol uint16) string {
+	switch protocol {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolUDP:
+		return "udp"
+	}
+	return fmt.Sprintf("%d", protocol)
+}
+
 // MessageTest is a test command message
 type MessageTest struct {
 	ID       uint32
@@ -69,6 +201,16 @@ type MessageTest struct {
 	Protocol uint16
 	SrcPort  uint16
 	DstPort  uint16
+
+	// TTL is the ttl or hop limit of the test packet, 0 is the default
+	TTL uint8 `json:",omitempty"`
+
+	// Malform is the name of the malformation of the test packet, empty
+	// for valid packets
+	Malform string `json:",omitempty"`
+
+	// Run is the id of the plan run of the test on the server
+	Run uint32 `json:"-"`
 }
 
 // GetType returns the type of the message
@@ -109,14 +251,89 @@ const (
 	ResultICMPv6HeadersTooLong
 	ResultTCPReset
 	ResultTimeout
+	ResultICMPv4TTLExceeded
+	ResultICMPv4ReassemblyExceeded
+	ResultICMPv4ParameterProblem
+	ResultICMPv4Redirect
+	ResultICMPv6PacketTooBig
+	ResultICMPv6HopLimitExceeded
+	ResultICMPv6ReassemblyExceeded
+	ResultICMPv6ParameterProblem
+	ResultICMPv6Redirect
 	ResultInvalid
 )
 
-// MessageResult is a test result message
+// resultNames contains the names of all test result values
+var resultNames = [...]string{
+	ResultNone:                      "none",
+	ResultReady:                     "ready",
+	ResultError:                     "error",
+	ResultPass:                      "pass",
+	ResultICMPv4NetworkUnreachable:  "icmpv4-network-unreachable",
+	ResultICMPv4HostUnreachable:     "icmpv4-host-unreachable",
+	ResultICMPv4ProtocolUnreachable: "icmpv4-protocol-unreachable",
+	ResultICMPv4PortUnreachable:     "icmpv4-port-unreachable",
+	ResultICMPv4FragmentationNeeded: "icmpv4-fragmentation-needed",
+	ResultICMPv4SourceRoutingFailed: "icmpv4-source-routing-failed",
+	ResultICMPv4NetworkUnknown:      "icmpv4-network-unknown",
+	ResultICMPv4HostUnknown:         "icmpv4-host-unknown",
+	ResultICMPv4SourceIsolated:      "icmpv4-source-isolated",
+	ResultICMPv4NetworkProhibited:   "icmpv4-network-prohibited",
+	ResultICMPv4HostProhibited:      "icmpv4-host-prohibited",
+	ResultICMPv4NetworkTOS:          "icmpv4-network-tos",
+	ResultICMPv4HostTOS:             "icmpv4-host-tos",
+	ResultICMPv4CommProhibited:      "icmpv4-comm-prohibited",
+	ResultICMPv4HostPrecedence:      "icmpv4-host-precedence",
+	ResultICMPv4PrecedenceCutoff:    "icmpv4-precedence-cutoff",
+	ResultICMPv6NoRouteToDst:        "icmpv6-no-route-to-dst",
+	ResultICMPv6AdminProhibited:     "icmpv6-admin-prohibited",
+	ResultICMPv6BeyondScopeOfSrc:    "icmpv6-beyond-scope-of-src",
+	ResultICMPv6AddressUnreachable:  "icmpv6-address-unreachable",
+	ResultICMPv6PortUnreachable:     "icmpv6-port-unreachable",
+	ResultICMPv6SrcAddressFailed:    "icmpv6-src-address-failed",
+	ResultICMPv6RejectRouteToDst:    "icmpv6-reject-route-to-dst",
+	ResultICMPv6SrcRoutingHeader:    "icmpv6-src-routing-header",
+	ResultICMPv6HeadersTooLong:      "icmpv6-headers-too-long",
+	ResultTCPReset:                  "tcp-reset",
+	ResultTimeout:                   "timeout",
+	ResultICMPv4TTLExceeded:         "icmpv4-ttl-exceeded",
+	ResultICMPv4ReassemblyExceeded:  "icmpv4-reassembly-exceeded",
+	ResultICMPv4ParameterProblem:    "icmpv4-parameter-problem",
+	ResultICMPv4Redirect:            "icmpv4-redirect",
+	ResultICMPv6PacketTooBig:        "icmpv6-packet-too-big",
+	ResultICMPv6HopLimitExceeded:    "icmpv6-hop-limit-exceeded",
+	ResultICMPv6ReassemblyExceeded:  "icmpv6-reassembly-exceeded",
+	ResultICMPv6ParameterProblem:    "icmpv6-parameter-problem",
+	ResultICMPv6Redirect:            "icmpv6-redirect",
+}
+
+// resultString converts a test result value to a string
+func resultString(result uint8) string {
+	if int(result) >= len(resultNames) {
+		return fmt.Sprintf("%d", result)
+	}
+	return resultNames[result]
+}
+
+// Test roles of clients
+const (
+	RoleNone = iota
+	RoleSender
+	RoleReceiver
+)
+
+// MessageResult is a test result message; Role is the role of the client in
+// the test, so a client can be sender and receiver of the same test
 type MessageResult struct {
 	ID     uint32
 	Result uint8
 	Packet []byte
+	Time   time.Time
+	Role   uint8
+
+	// Run is the id of the plan run of the test, 0 if the client does
+	// not support it
+	Run uint32 `json:"-"`
 }
 
 // GetType returns the type of the message
@@ -124,7 +341,40 @@ func (m *MessageResult) GetType() uint8 {
 	return MessageTypeResult
 }
 
-// TLVMessage is a TLV message
+// newMessage creates an empty message of type typ; it returns nil if typ is
+// not a valid message type
+func newMessage(typ uint8) Message {
+	switch typ {
+	case MessageTypeNop:
+		// no operation message
+		return &MessageNop{}
+
+	case MessageTypeRegister:
+		// register message
+		return &MessageRegister{}
+
+	case MessageTypeTest:
+		// test message
+		return &MessageTest{}
+
+	case MessageTypeResult:
+		// result message
+		return &MessageResult{}
+
+	case MessageTypeRegisterReply:
+		// register reply message
+		return &MessageRegisterReply{}
+
+	case MessageTypeError:
+		// error message
+		return &MessageError{}
+	}
+
+	// invalid message
+	return nil
+}
+
+// TLVMessage is a TLV message in the legacy format
 type TLVMessage struct {
 	Type   uint8
 	Length uint16
@@ -132,7 +382,7 @@ type TLVMessage struct {
 }
 
 // serialize encodes a message as bytes
-func (m *TLVMessage) serialize() []byte {
+func (m *TLVMessage) serialize() ([]byte, error) {
 	var buf bytes.Buffer
 
 	var data = []interface{}{
@@ -143,115 +393,266 @@ func (m *TLVMessage) serialize() []byte {
 	for _, v := range data {
 		err := binary.Write(&buf, binary.BigEndian, v)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 	}
 
-	return buf.Bytes()
+	return buf.Bytes(), nil
 }
 
 // readBytes reads length bytes from conn
-func readBytes(conn net.Conn, length uint16) []byte {
+func readBytes(conn net.Conn, length int) ([]byte, error) {
 	buf := make([]byte, length)
 	count := 0
-	for count < int(length) {
+	for count < length {
 		n, err := conn.Read(buf[count:])
 		if err != nil {
-			log.Printf("Connection to %s: %s\n",
-				conn.RemoteAddr(), err)
-			return nil
+			return nil, err
 		}
 		count += n
 	}
-	return buf
+	return buf, nil
 }
 
 // writeBytes writes buf to conn
-func writeBytes(conn net.Conn, buf []byte) bool {
+func writeBytes(conn net.Conn, buf []byte) error {
 	count := 0
 	for count < len(buf) {
 		n, err := conn.Write(buf[count:])
 		if err != nil {
-			return false
+			return err
 		}
 		count += n
 	}
-	return true
+	return nil
 }
 
-// readMessage reads the next Message from conn
-func readMessage(conn net.Conn) Message {
-	// read header from connection
-	headerBytes := readBytes(conn, MessageHeaderLength)
-	if headerBytes == nil {
-		return nil
+// compressData compresses data
+func compressData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressData decompresses data; it fails if data is invalid or exceeds
+// the maximum message length after decompression
+func decompressData(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, MessageBinaryMaxLength+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	if len(b) > MessageBinaryMaxLength {
+		return nil, fmt.Errorf("%w: decompressed length exceeds %d",
+			ErrTooLong, MessageBinaryMaxLength)
 	}
+	return b, nil
+}
 
-	// parse header
-	typ := headerBytes[0]
-	length := binary.BigEndian.Uint16(headerBytes[1:3])
+// checkLength checks if the message length is valid for a message with
+// header length and maximum length max
+func checkLength(length, header, max int) error {
+	if length < header {
+		return fmt.Errorf("%w: invalid message length %d", ErrDecode,
+			length)
+	}
+	if length > max {
+		return fmt.Errorf("%w: length %d exceeds %d", ErrTooLong,
+			length, max)
+	}
+	return nil
+}
 
-	// make sure message type is valid
-	if typ == MessageTypeNone || typ >= MessageTypeInvalid {
-		return nil
+// readLegacyMessage reads the remaining legacy message with type typ from
+// conn
+func readLegacyMessage(conn net.Conn, typ uint8) (Message, error) {
+	// read length from connection
+	lengthBytes, err := readBytes(conn, MessageHeaderLength-1)
+	if err != nil {
+		return nil, err
 	}
+	length := int(binary.BigEndian.Uint16(lengthBytes))
 
 	// make sure message length is valid
-	if length < MessageHeaderLength || length > MessageMaxLength {
-		return nil
+	err = checkLength(length, MessageHeaderLength, MessageMaxLength)
+	if err != nil {
+		return nil, err
 	}
 
 	// read remaining message data from connection
-	data := readBytes(conn, length-MessageHeaderLength)
-	if data == nil {
-		return nil
+	data, err := readBytes(conn, length-MessageHeaderLength)
+	if err != nil {
+		return nil, err
 	}
 
-	// create message
-	var msg Message = nil
-	switch typ {
-	case MessageTypeNop:
-		// no operation message
-		msg = &MessageNop{}
+	// fill message fields from data
+	msg := newMessage(typ)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return msg, nil
+}
 
-	case MessageTypeRegister:
-		// register message
-		msg = &MessageRegister{}
+// readBinaryMessage reads the remaining binary message with type typ from
+// conn
+func readBinaryMessage(conn net.Conn, typ uint8) (Message, error) {
+	// read flags and length from connection
+	headerBytes, err := readBytes(conn, MessageBinaryHeaderLength-1)
+	if err != nil {
+		return nil, err
+	}
+	flags := headerBytes[0]
+	length := int(binary.BigEndian.Uint32(headerBytes[1:5]))
 
-	case MessageTypeTest:
-		// test message
-		msg = &MessageTest{}
+	// make sure message length is valid
+	err = checkLength(length, MessageBinaryHeaderLength,
+		MessageBinaryMaxLength)
+	if err != nil {
+		return nil, err
+	}
 
-	case MessageTypeResult:
-		// result message
-		msg = &MessageResult{}
+	// read remaining message data from connection
+	data, err := readBytes(conn, length-MessageBinaryHeaderLength)
+	if err != nil {
+		return nil, err
+	}
+	if flags&MessageFlagCompressed != 0 {
+		data, err = decompressData(data)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	default:
-		// invalid message
-		return nil
+	// fill message fields from data; trailing data is ignored, so newer
+	// versions can append fields to messages
+	msg := newMessage(typ)
+	d := &messageDecoder{b: data}
+	msg.decode(d)
+	if d.err != nil {
+		return nil, d.err
 	}
+	return msg, nil
+}
 
-	// fill message fields from data
-	err := json.Unmarshal(data, msg)
+// readMessageFormat reads the next Message from conn and returns whether it
+// is in the legacy format
+func readMessageFormat(conn net.Conn) (Message, bool, error) {
+	// read type from connection
+	typeBytes, err := readBytes(conn, 1)
 	if err != nil {
-		return nil
+		return nil, false, err
+	}
+	typ := typeBytes[0]
+
+	// make sure message type is valid
+	binaryFormat := typ&MessageFlagBinary != 0
+	typ &^= MessageFlagBinary
+	if typ == MessageTypeNone || typ >= MessageTypeInvalid {
+		return nil, !binaryFormat, fmt.Errorf("%w %d", ErrUnknownType,
+			typ)
 	}
 
-	// return msg
-	return msg
+	if binaryFormat {
+		msg, err := readBinaryMessage(conn, typ)
+		return msg, false, err
+	}
+	msg, err := readLegacyMessage(conn, typ)
+	return msg, true, err
 }
 
-// writeMessage writes message to conn
-func writeMessage(conn net.Conn, message Message) bool {
+// readMessage reads the next Message from conn; it reads messages in the
+// binary format and in the legacy format
+func readMessage(conn net.Conn) (Message, error) {
+	msg, _, err := readMessageFormat(conn)
+	return msg, err
+}
+
+// writeMessage writes message to conn in the binary format; message data
+// is compressed if it is long enough and compression reduces its length
+func writeMessage(conn net.Conn, message Message) error {
+	e := &messageEncoder{}
+	message.encode(e)
+	data := e.bytes()
+	flags := uint8(0)
+	if len(data) >= MessageCompressLength {
+		c, err := compressData(data)
+		if err != nil {
+			return err
+		}
+		if len(c) < len(data) {
+			data = c
+			flags |= MessageFlagCompressed
+		}
+	}
+
+	length := len(data) + MessageBinaryHeaderLength
+	if length > MessageBinaryMaxLength {
+		return fmt.Errorf("%w: length %d exceeds %d", ErrTooLong,
+			length, MessageBinaryMaxLength)
+	}
+	buf := make([]byte, MessageBinaryHeaderLength, length)
+	buf[0] = message.GetType() | MessageFlagBinary
+	buf[1] = flags
+	binary.BigEndian.PutUint32(buf[2:], uint32(length))
+	buf = append(buf, data...)
+	return writeBytes(conn, buf)
+}
+
+// writeLegacyMessage writes message to conn in the legacy format
+func writeLegacyMessage(conn net.Conn, message Message) error {
 	b, err := json.Marshal(message)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	length := len(b) + MessageHeaderLength
+	if length > MessageMaxLength {
+		return fmt.Errorf("%w: length %d exceeds %d", ErrTooLong,
+			length, MessageMaxLength)
 	}
 	tlv := TLVMessage{
 		message.GetType(),
-		uint16(len(b)) + MessageHeaderLength,
+		uint16(length),
 		b,
 	}
-	buf := tlv.serialize()
+	buf, err := tlv.serialize()
+	if err != nil {
+		return err
+	}
 	return writeBytes(conn, buf)
 }
+
+// isProtocolError checks if err is caused by an invalid message
+func isProtocolError(err error) bool {
+	return errors.Is(err, ErrUnknownType) || errors.Is(err, ErrTooLong) ||
+		errors.Is(err, ErrDecode)
+}
+
+// reportProtocolError logs the protocol violation with reason on conn and
+// reports it to the peer with an error message
+func reportProtocolError(conn net.Conn, reason string) {
+	log.Printf("Protocol error on connection to %s: %s",
+		conn.RemoteAddr(), reason)
+	if err := writeMessage(conn, &MessageError{reason}); err != nil {
+		log.Printf("Connection to %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// handleReadError logs the error err that occurred while reading from conn;
+// if err is caused by an invalid message, it is reported to the peer
+func handleReadError(conn net.Conn, err error) {
+	if isProtocolError(err) {
+		reportProtocolError(conn, err.Error())
+		return
+	}
+	log.Printf("Connection to %s: %s", conn.RemoteAddr(), err)
+}
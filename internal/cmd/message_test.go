@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"net"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -16,12 +18,15 @@ func TestReadWriteBytes(t *testing.T) {
 	}
 	data := []byte{1, 2, 3, 4, 5, 6}
 	go func() {
-		if !writeBytes(in, data) {
+		if err := writeBytes(in, data); err != nil {
 			log.Fatal("error writing to conn")
 		}
 	}()
 	want := data
-	got := readBytes(out, uint16(len(data)))
+	got, err := readBytes(out, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if bytes.Compare(got, want) != 0 {
 		t.Errorf("got %v, want %v", got, want)
 	}
@@ -35,12 +40,15 @@ func TestReadWriteMessage(t *testing.T) {
 	}
 	msg := &MessageNop{}
 	go func() {
-		if !writeMessage(in, msg) {
+		if err := writeMessage(in, msg); err != nil {
 			log.Fatal("error writing to conn")
 		}
 	}()
 	want := msg
-	got := readMessage(out)
+	got, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if got != want {
 		t.Errorf("got %v, want %v", got, want)
 	}
@@ -55,12 +63,16 @@ func TestMessageNop(t *testing.T) {
 
 	msg := &MessageNop{}
 	go func() {
-		if !writeMessage(in, msg) {
+		if err := writeMessage(in, msg); err != nil {
 			log.Fatal("error writing to conn")
 		}
 	}()
 	want := msg.GetType()
-	got := readMessage(out).GetType()
+	m, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.GetType()
 	if got != want {
 		t.Errorf("got %d, want %d", got, want)
 	}
@@ -73,18 +85,194 @@ func TestMessageRegister(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	msg := &MessageRegister{Client: 1}
+	msg := &MessageRegister{
+		Client:    1,
+		Token:     "secret",
+		Version:   ProtocolVersion,
+		Protocols: []uint16{ProtocolTCP, ProtocolUDP},
+		Features:  ClientFeatures,
+		Interfaces: []*MessageInterface{{
+			Name: "veth2",
+			MAC:  net.HardwareAddr{0x0a, 0xbc, 0xde, 0xf0, 0x00, 0x12},
+			IPs:  []net.IP{net.ParseIP("192.168.1.1")},
+		}},
+	}
 	go func() {
-		if !writeMessage(in, msg) {
+		if err := writeMessage(in, msg); err != nil {
 			log.Fatal("error writing to conn")
 		}
 	}()
 	want := msg
-	got := readMessage(out)
+	got, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if got.GetType() != want.GetType() {
 		t.Errorf("got %d, want %d", got.GetType(), want.GetType())
 	}
-	if *got.(*MessageRegister) != *want {
+	if !reflect.DeepEqual(got.(*MessageRegister), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestMessageTest tests test messages with ttl and malformation
+func TestMessageTest(t *testing.T) {
+	in, out := net.Pipe()
+	if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		log.Fatal(err)
+	}
+
+	msg := &MessageTest{
+		ID:       1,
+		Initiate: true,
+		Device:   "veth2",
+		SrcMAC:   net.HardwareAddr{0x0a, 0xbc, 0xde, 0xf0, 0x00, 0x12},
+		DstMAC:   net.HardwareAddr{0x0a, 0xbc, 0xde, 0xf0, 0x00, 0x22},
+		SrcIP:    net.ParseIP("192.168.1.1"),
+		DstIP:    net.ParseIP("192.168.2.1"),
+		Protocol: ProtocolTCP,
+		SrcPort:  32768,
+		DstPort:  80,
+		TTL:      3,
+		Malform:  MalformLand,
+		Run:      7,
+	}
+	go func() {
+		if err := writeMessage(in, msg); err != nil {
+			log.Fatal("error writing to conn")
+		}
+	}()
+	want := msg
+	got, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+// TestMessageResult tests large result messages that are compressed
+func TestMessageResult(t *testing.T) {
+	in, out := net.Pipe()
+	if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		log.Fatal(err)
+	}
+
+	msg := &MessageResult{
+		ID:     42,
+		Result: ResultPass,
+		Packet: bytes.Repeat([]byte{0xab}, 2*MessageMaxLength),
+		Time:   time.Unix(1700000000, 123456789),
+		Run:    7,
+	}
+	go func() {
+		if err := writeMessage(in, msg); err != nil {
+			log.Fatal("error writing to conn")
+		}
+	}()
+	m, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := m.(*MessageResult)
+	if !ok {
+		t.Fatalf("got no result message")
+	}
+	if got.ID != msg.ID || got.Result != msg.Result || got.Run != msg.Run ||
+		!bytes.Equal(got.Packet, msg.Packet) || !got.Time.Equal(msg.Time) {
+		t.Errorf("got %v, want %v", got, msg)
+	}
+}
+
+// TestReadLegacyMessage tests reading messages in the legacy format
+func TestReadLegacyMessage(t *testing.T) {
+	in, out := net.Pipe()
+	if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		log.Fatal(err)
+	}
+
+	msg := &MessageTest{
+		ID:       1,
+		Device:   "veth2",
+		SrcIP:    net.ParseIP("192.168.1.1"),
+		DstIP:    net.ParseIP("192.168.2.1"),
+		Protocol: ProtocolTCP,
+		SrcPort:  32768,
+		DstPort:  80,
+	}
+	go func() {
+		if err := writeLegacyMessage(in, msg); err != nil {
+			log.Fatal("error writing to conn")
+		}
+	}()
+	got, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("got %v, want %v", got, msg)
+	}
+}
+
+// TestMessageError tests error messages
+func TestMessageError(t *testing.T) {
+	in, out := net.Pipe()
+	if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		log.Fatal(err)
+	}
+
+	msg := &MessageError{Reason: "unexpected message type 2"}
+	go func() {
+		if err := writeMessage(in, msg); err != nil {
+			log.Fatal("error writing to conn")
+		}
+	}()
+	got, err := readMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("got %v, want %v", got, msg)
+	}
+}
+
+// TestReadMessageErrors tests reading invalid messages
+func TestReadMessageErrors(t *testing.T) {
+	test := func(data []byte, want error) {
+		in, out := net.Pipe()
+		if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			_ = writeBytes(in, data)
+			_ = in.Close()
+		}()
+		_, err := readMessage(out)
+		if !errors.Is(err, want) {
+			t.Errorf("got %v, want %v", err, want)
+		}
+		if !isProtocolError(err) {
+			t.Errorf("got %v, want protocol error", err)
+		}
+	}
+
+	// unknown legacy and binary message types
+	test([]byte{0, 0, 3}, ErrUnknownType)
+	test([]byte{MessageTypeInvalid, 0, 3}, ErrUnknownType)
+	test([]byte{MessageTypeInvalid | MessageFlagBinary, 0, 0, 0, 0, 6},
+		ErrUnknownType)
+
+	// too long legacy and binary messages
+	test([]byte{MessageTypeNop, 0xff, 0xff}, ErrTooLong)
+	test([]byte{MessageTypeNop | MessageFlagBinary, 0, 0xff, 0xff, 0xff,
+		0xff}, ErrTooLong)
+
+	// invalid lengths and data
+	test([]byte{MessageTypeNop, 0, 2}, ErrDecode)
+	test([]byte{MessageTypeNop, 0, 4, '{'}, ErrDecode)
+	test([]byte{MessageTypeResult | MessageFlagBinary, 0, 0, 0, 0, 8, 0,
+		1}, ErrDecode)
+	test([]byte{MessageTypeNop | MessageFlagBinary, MessageFlagCompressed,
+		0, 0, 0, 7, 0xff}, ErrDecode)
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric names
+const (
+	MetricItemsCompleted   = "middleboxer_items_completed_total"
+	MetricItemVerdicts     = "middleboxer_item_verdicts_total"
+	MetricItemLatency      = "middleboxer_item_latency_seconds"
+	MetricResults          = "middleboxer_results_total"
+	MetricMessageBacklog   = "middleboxer_message_backlog"
+	MetricClientsConnected = "middleboxer_clients_connected"
+	MetricPacketsSent      = "middleboxer_packets_sent_total"
+	MetricPacketsCaptured  = "middleboxer_packets_captured_total"
+	MetricPcapDropped      = "middleboxer_pcap_dropped_packets_total"
+	MetricPcapIfDropped    = "middleboxer_pcap_interface_dropped_packets_total"
+)
+
+// metric types
+const (
+	metricTypeCounter   = "counter"
+	metricTypeGauge     = "gauge"
+	metricTypeHistogram = "histogram"
+)
+
+// metricLatencyBuckets are the upper bounds of the item latency histogram
+// buckets in seconds
+var metricLatencyBuckets = []float64{
+	0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+var (
+	// metrics contains the metrics of the server and the clients
+	metrics = newMetricRegistry(
+		newMetric(MetricItemsCompleted, metricTypeCounter,
+			"Number of completed plan items."),
+		newMetric(MetricItemVerdicts, metricTypeCounter,
+			"Number of plan items of finished plans by verdict."),
+		newMetric(MetricItemLatency, metricTypeHistogram,
+			"Time from dispatching a plan item to its completion."),
+		newMetric(MetricResults, metricTypeCounter,
+			"Number of results received from clients by result."),
+		newMetric(MetricMessageBacklog, metricTypeGauge,
+			"Number of client messages waiting for the server."),
+		newMetric(MetricClientsConnected, metricTypeGauge,
+			"Number of connected clients."),
+		newMetric(MetricPacketsSent, metricTypeCounter,
+			"Number of probe packets sent by device."),
+		newMetric(MetricPacketsCaptured, metricTypeCounter,
+			"Number of packets captured by device."),
+		newMetric(MetricPcapDropped, metricTypeCounter,
+			"Number of packets dropped by pcap by device."),
+		newMetric(MetricPcapIfDropped, metricTypeCounter,
+			"Number of packets dropped by the interface by device."),
+	)
+)
+
+// metricLabels converts label names and values to a label string, e.g.,
+// `{device="eth0"}`
+func metricLabels(labels ...string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	s := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s = append(s, fmt.Sprintf(`%s="%s"`, labels[i],
+			escape.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
+
+// metricHistogram is a histogram with the number of observed values per
+// bucket
+type metricHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// metric is a metric with all its values identified by their labels
+type metric struct {
+	name       string
+	typ        string
+	help       string
+	values     map[string]float64
+	histograms map[string]*metricHistogram
+}
+
+// write writes the metric in prometheus text format to w
+func (m *metric) write(w io.Writer) error {
+	s := fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", m.name, m.help,
+		m.name, m.typ)
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	for _, labels := range slices.Sorted(maps.Keys(m.values)) {
+		s += fmt.Sprintf("%s%s %s\n", m.name, labels,
+			formatFloat(m.values[labels]))
+	}
+	for _, labels := range slices.Sorted(maps.Keys(m.histograms)) {
+		h := m.histograms[labels]
+		bucketLabels := func(le string) string {
+			l := `le="` + le + `"`
+			if labels == "" {
+				return "{" + l + "}"
+			}
+			return labels[:len(labels)-1] + "," + l + "}"
+		}
+		count := uint64(0)
+		for i, b := range metricLatencyBuckets {
+			count += h.buckets[i]
+			s += fmt.Sprintf("%s_bucket%s %d\n", m.name,
+				bucketLabels(formatFloat(b)), count)
+		}
+		s += fmt.Sprintf("%s_bucket%s %d\n", m.name,
+			bucketLabels("+Inf"), h.count)
+		s += fmt.Sprintf("%s_sum%s %s\n", m.name, labels,
+			formatFloat(h.sum))
+		s += fmt.Sprintf("%s_count%s %d\n", m.name, labels, h.count)
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// newMetric creates a new metric with name, type and help text
+func newMetric(name, typ, help string) *metric {
+	return &metric{
+		name:       name,
+		typ:        typ,
+		help:       help,
+		values:     make(map[string]float64),
+		histograms: make(map[string]*metricHistogram),
+	}
+}
+
+// metricRegistry is a collection of metrics
+type metricRegistry struct {
+	sync.Mutex
+	metrics []*metric
+}
+
+// get returns the metric with name
+func (r *metricRegistry) get(name string) *metric {
+	for _, m := range r.metrics {
+		if m.name == name {
+			return m
+		}
+	}
+	log.Fatal("unknown metric: ", name)
+	return nil
+}
+
+// add adds v to the value of the metric with name and labels
+func (r *metricRegistry) add(name string, v float64, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.get(name).values[metricLabels(labels...)] += v
+}
+
+// set sets the value of the metric with name and labels to v
+func (r *metricRegistry) set(name string, v float64, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.get(name).values[metricLabels(labels...)] = v
+}
+
+// observe adds the value v to the histogram with name and labels
+func (r *metricRegistry) observe(name string, v float64, labels ...string) {
+	r.Lock()
+	defer r.Unlock()
+	m := r.get(name)
+	l := metricLabels(labels...)
+	h := m.histograms[l]
+	if h == nil {
+		h = &metricHistogram{
+			buckets: make([]uint64, len(metricLatencyBuckets)),
+		}
+		m.histograms[l] = h
+	}
+	if i, _ := slices.BinarySearch(metricLatencyBuckets, v); i <
+		len(metricLatencyBuckets) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes all metrics in prometheus text format to w
+func (r *metricRegistry) write(w io.Writer) error {
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newMetricRegistry creates a new metric registry with metrics
+func newMetricRegistry(metrics ...*metric) *metricRegistry {
+	return &metricRegistry{
+		metrics: metrics,
+	}
+}
+
+// handleMetrics writes all metrics to w
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	packetListeners.updateMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.write(w); err != nil {
+		log.Println("Error writing metrics:", err)
+	}
+}
+
+// serveMetrics runs the metrics endpoint on address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	log.Println("Metrics listening on:", address)
+	log.Fatal(http.ListenAndServe(address, mux))
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"log"
+	"os"
+)
+
+// Example_metricRegistry shows writing metrics in prometheus text format
+func Example_metricRegistry() {
+	r := newMetricRegistry(
+		newMetric(MetricItemsCompleted, metricTypeCounter,
+			"Number of completed plan items."),
+		newMetric(MetricPacketsSent, metricTypeCounter,
+			"Number of probe packets sent by device."),
+		newMetric(MetricItemLatency, metricTypeHistogram,
+			"Time from dispatching a plan item to its completion."),
+	)
+	r.add(MetricItemsCompleted, 1)
+	r.add(MetricItemsCompleted, 2)
+	r.add(MetricPacketsSent, 3, "device", "veth2")
+	r.add(MetricPacketsSent, 1, "device", "eth\"0")
+	r.observe(MetricItemLatency, 0.02)
+	r.observe(MetricItemLatency, 0.1)
+	r.observe(MetricItemLatency, 20)
+	if err := r.write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// # HELP middleboxer_items_completed_total Number of completed plan items.
+	// # TYPE middleboxer_items_completed_total counter
+	// middleboxer_items_completed_total 3
+	// # HELP middleboxer_packets_sent_total Number of probe packets sent by device.
+	// # TYPE middleboxer_packets_sent_total counter
+	// middleboxer_packets_sent_total{device="eth\"0"} 1
+	// middleboxer_packets_sent_total{device="veth2"} 3
+	// # HELP middleboxer_item_latency_seconds Time from dispatching a plan item to its completion.
+	// # TYPE middleboxer_item_latency_seconds histogram
+	// middleboxer_item_latency_seconds_bucket{le="0.01"} 0
+	// middleboxer_item_latency_seconds_bucket{le="0.025"} 1
+	// middleboxer_item_latency_seconds_bucket{le="0.05"} 1
+	// middleboxer_item_latency_seconds_bucket{le="0.1"} 2
+	// middleboxer_item_latency_seconds_bucket{le="0.25"} 2
+	// middleboxer_item_latency_seconds_bucket{le="0.5"} 2
+	// middleboxer_item_latency_seconds_bucket{le="1"} 2
+	// middleboxer_item_latency_seconds_bucket{le="2.5"} 2
+	// middleboxer_item_latency_seconds_bucket{le="5"} 2
+	// middleboxer_item_latency_seconds_bucket{le="10"} 2
+	// middleboxer_item_latency_seconds_bucket{le="+Inf"} 3
+	// middleboxer_item_latency_seconds_sum 20.12
+	// middleboxer_item_latency_seconds_count 3
+}
@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// nftChain is a chain in the json output of nft
+type nftChain struct {
+	Family string
+	Table  string
+	Name   string
+	Hook   string
+	Policy string
+}
+
+// nftRule is a rule in the json output of nft
+type nftRule struct {
+	Family string
+	Table  string
+	Chain  string
+	Handle int
+	Expr   []map[string]json.RawMessage
+}
+
+// nftPayload is a payload expression in the json output of nft
+type nftPayload struct {
+	Protocol string
+	Field    string
+}
+
+// nftMatch is a match statement in the json output of nft
+type nftMatch struct {
+	Op    string
+	Left  map[string]json.RawMessage
+	Right interface{}
+}
+
+// nftRange is a range of values in the json output of nft
+type nftRange struct {
+	first interface{}
+	last  interface{}
+}
+
+// getNFTValues returns the values in v with sets and lists flattened and
+// ranges converted to nftRange
+func getNFTValues(v interface{}) ([]interface{}, error) {
+	// handle lists, e.g., of ct states
+	if list, ok := v.([]interface{}); ok {
+		values := []interface{}{}
+		for _, e := range list {
+			vs, err := getNFTValues(e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, vs...)
+		}
+		return values, nil
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []interface{}{v}, nil
+	}
+
+	// handle sets
+	if set, ok := m["set"].([]interface{}); ok {
+		return getNFTValues(set)
+	}
+
+	// handle ranges
+	if r, ok := m["range"].([]interface{}); ok && len(r) == 2 {
+		return []interface{}{&nftRange{r[0], r[1]}}, nil
+	}
+
+	// handle prefixes
+	if p, ok := m["prefix"].(map[string]interface{}); ok {
+		return []interface{}{fmt.Sprintf("%v/%v", p["addr"], p["len"])},
+			nil
+	}
+
+	return nil, fmt.Errorf("unsupported value: %v", v)
+}
+
+// getNFTPort converts v to a port number
+func getNFTPort(v interface{}) (uint16, error) {
+	f, ok := v.(float64)
+	if !ok || f < 1 || f > 65535 {
+		return 0, fmt.Errorf("unsupported port: %v", v)
+	}
+	return uint16(f), nil
+}
+
+// parseNFTPorts parses the port values in v
+func parseNFTPorts(v interface{}) ([]*importPortRange, error) {
+	values, err := getNFTValues(v)
+	if err != nil {
+		return nil, err
+	}
+	ports := []*importPortRange{}
+	for _, value := range values {
+		first, last := value, value
+		if r, ok := value.(*nftRange); ok {
+			first, last = r.first, r.last
+		}
+		f, err := getNFTPort(first)
+		if err != nil {
+			return nil, err
+		}
+		l, err := getNFTPort(last)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, &importPortRange{f, l})
+	}
+	return ports, nil
+}
+
+// parseNFTProtocol parses the protocol value in v
+func parseNFTProtocol(v interface{}) (uint16, error) {
+	values, err := getNFTValues(v)
+	if err != nil {
+		return ProtocolNone, err
+	}
+	if len(values) != 1 {
+		return ProtocolNone, fmt.Errorf("unsupported protocols: %v", v)
+	}
+	return parseProtocol(fmt.Sprint(values[0]))
+}
+
+// parseNFTMatch parses the match statement m and adds it to rule; it
+// returns false if the rule never matches probes
+func parseNFTMatch(rule *importRule, m *nftMatch) (bool, error) {
+	if m.Op != "==" && m.Op != "in" {
+		return false, fmt.Errorf("unsupported operator: %s", m.Op)
+	}
+
+	// handle payload matches
+	if raw, ok := m.Left["payload"]; ok {
+		p := nftPayload{}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return false, err
+		}
+		switch {
+		case p.Field == "dport":
+			if p.Protocol != "th" {
+				protocol, err := parseProtocol(p.Protocol)
+				if err != nil {
+					return false, err
+				}
+				rule.protocol = protocol
+			}
+			ports, err := parseNFTPorts(m.Right)
+			if err != nil {
+				return false, err
+			}
+			rule.ports = ports
+		case p.Field == "saddr" || p.Field == "daddr":
+			values, err := getNFTValues(m.Right)
+			if err != nil {
+				return false, err
+			}
+			for _, v := range values {
+				s, ok := v.(string)
+				if !ok {
+					return false, fmt.Errorf(
+						"unsupported address: %v", v)
+				}
+				n, err := parseNetwork(s)
+				if err != nil {
+					return false, err
+				}
+				if p.Field == "saddr" {
+					rule.src = append(rule.src, n)
+				} else {
+					rule.dst = append(rule.dst, n)
+				}
+			}
+		case p.Field == "protocol" || p.Field == "nexthdr":
+			protocol, err := parseNFTProtocol(m.Right)
+			if err != nil {
+				return false, err
+			}
+			rule.protocol = protocol
+		default:
+			return false, fmt.Errorf("unsupported payload: %s %s",
+				p.Protocol, p.Field)
+		}
+		return true, nil
+	}
+
+	// handle meta matches
+	if raw, ok := m.Left["meta"]; ok {
+		meta := struct{ Key string }{}
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return false, err
+		}
+		switch meta.Key {
+		case "l4proto":
+			protocol, err := parseNFTProtocol(m.Right)
+			if err != nil {
+				return false, err
+			}
+			rule.protocol = protocol
+		case "iif", "oif", "iifname", "oifname", "nfproto":
+			// interfaces and families are defined by the test setup
+		default:
+			return false, fmt.Errorf("unsupported meta: %s", meta.Key)
+		}
+		return true, nil
+	}
+
+	// handle conntrack matches, probes only create new connections
+	if raw, ok := m.Left["ct"]; ok {
+		ct := struct{ Key string }{}
+		if err := json.Unmarshal(raw, &ct); err != nil {
+			return false, err
+		}
+		if ct.Key != "state" {
+			return false, fmt.Errorf("unsupported ct: %s", ct.Key)
+		}
+		values, err := getNFTValues(m.Right)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range values {
+			if v == "new" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unsupported match: %v", m.Left)
+}
+
+// parseNFTRule parses the expressions of an nft rule
+func parseNFTRule(r *nftRule) (*importRule, error) {
+	rule := &importRule{}
+	for _, expr := range r.Expr {
+		for key, raw := range expr {
+			switch key {
+			case "match":
+				m := nftMatch{}
+				if err := json.Unmarshal(raw, &m); err != nil {
+					return nil, err
+				}
+				ok, err := parseNFTMatch(rule, &m)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					return nil, nil
+				}
+			case "counter", "log", "limit":
+				// ignore statements without effect on verdict
+			case "accept":
+				rule.result = planResultPass
+				return rule, nil
+			case "reject":
+				rule.result = planResultReject
+				return rule, nil
+			case "drop":
+				rule.result = planResultDrop
+				return rule, nil
+			default:
+				return nil, fmt.Errorf("unsupported statement: %s",
+					key)
+			}
+		}
+	}
+	return nil, fmt.Errorf("missing verdict")
+}
+
+// parseNFTPolicy parses the policy of an nft chain as plan result
+func parseNFTPolicy(policy string) uint8 {
+	if policy == "drop" {
+		return planResultDrop
+	}
+	return planResultPass
+}
+
+// parseNFTables parses the filter rules of chain in the json output of
+// "nft -j list ruleset"; an empty chain defaults to the first chain with a
+// forward hook
+func parseNFTables(b []byte, chain string) (*importRuleset, error) {
+	objects := struct {
+		Nftables []map[string]json.RawMessage
+	}{}
+	if err := json.Unmarshal(b, &objects); err != nil {
+		return nil, err
+	}
+
+	// find chain
+	var c *nftChain
+	for _, o := range objects.Nftables {
+		raw, ok := o["chain"]
+		if !ok {
+			continue
+		}
+		oc := &nftChain{}
+		if err := json.Unmarshal(raw, oc); err != nil {
+			return nil, err
+		}
+		if (chain == "" && oc.Hook == "forward") || oc.Name == chain {
+			c = oc
+			break
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("chain not found: %s", chain)
+	}
+	ruleset := &importRuleset{policy: parseNFTPolicy(c.Policy)}
+
+	// parse rules in chain
+	for _, o := range objects.Nftables {
+		raw, ok := o["rule"]
+		if !ok {
+			continue
+		}
+		r := &nftRule{}
+		if err := json.Unmarshal(raw, r); err != nil {
+			return nil, err
+		}
+		if r.Family != c.Family || r.Table != c.Table ||
+			r.Chain != c.Name {
+			continue
+		}
+		rule, err := parseNFTRule(r)
+		if err != nil {
+			log.Printf("Skipping rule %d: %s", r.Handle, err)
+			ruleset.skipped++
+			continue
+		}
+		if rule == nil {
+			log.Printf("Skipping rule %d: does not match new "+
+				"connections", r.Handle)
+			continue
+		}
+		ruleset.rules = append(ruleset.rules, rule)
+	}
+	return ruleset, nil
+}
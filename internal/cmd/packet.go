@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"log"
 	"sync"
 
 	"github.com/gopacket/gopacket"
@@ -31,6 +32,24 @@ func (p *packetListenerMap) get(device string) *packetListener {
 	return l
 }
 
+// updateMetrics updates the pcap drop metrics of all packet listeners
+func (p *packetListenerMap) updateMetrics() {
+	p.Lock()
+	defer p.Unlock()
+
+	for device, l := range p.listeners {
+		stats, err := l.listener.PcapHandle.Stats()
+		if err != nil {
+			log.Println("Error getting pcap stats:", err)
+			continue
+		}
+		metrics.set(MetricPcapDropped, float64(stats.PacketsDropped),
+			"device", device)
+		metrics.set(MetricPcapIfDropped,
+			float64(stats.PacketsIfDropped), "device", device)
+	}
+}
+
 // newPacketListenerMap creates a packet listener map
 func newPacketListenerMap() *packetListenerMap {
 	return &packetListenerMap{
@@ -46,6 +65,7 @@ type packetListenerReg struct {
 
 // packetListener is a pcap packet listener
 type packetListener struct {
+	device   string
 	listener pcap.Listener
 	handlers []pcap.PacketHandler
 	regs     chan packetListenerReg
@@ -104,6 +124,7 @@ func (p *packetListener) loop() {
 			if !more {
 				return
 			}
+			metrics.add(MetricPacketsCaptured, 1, "device", p.device)
 			for _, h := range p.handlers {
 				h.HandlePacket(packet)
 			}
@@ -126,6 +147,7 @@ func (p *packetListener) loop() {
 func newPacketListener(device string) *packetListener {
 	// create packet listener
 	p := &packetListener{
+		device:  device,
 		regs:    make(chan packetListenerReg),
 		packets: make(chan gopacket.Packet),
 	}
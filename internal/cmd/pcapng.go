@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// pcapng block types, option codes and link types
+const (
+	pcapngBlockTypeSectionHeader        = 0x0A0D0D0A
+	pcapngBlockTypeInterfaceDescription = 0x00000001
+	pcapngBlockTypeEnhancedPacket       = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptionEndOfOpt = 0
+	pcapngOptionComment  = 1
+	pcapngOptionIfName   = 2
+	pcapngOptionIfDescr  = 3
+
+	pcapngLinkTypeEthernet = 1
+)
+
+// pcapngInterface is a capture interface of a client
+type pcapngInterface struct {
+	client uint8
+	device string
+}
+
+// pcapngWriter writes packets to a pcapng file; in contrast to the pcapng
+// writer in gopacket, it supports comments on packets
+type pcapngWriter struct {
+	w          io.Writer
+	interfaces map[pcapngInterface]uint32
+}
+
+// pcapngPad returns the padding needed to align length to 32 bits
+func pcapngPad(length int) int {
+	return (4 - length%4) % 4
+}
+
+// writeOption writes the option with code and value to buf
+func (p *pcapngWriter) writeOption(buf *bytes.Buffer, code uint16,
+	value []byte) {
+	_ = binary.Write(buf, binary.LittleEndian, code)
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(make([]byte, pcapngPad(len(value))))
+}
+
+// writeBlock writes a block with type typ and body to the file
+func (p *pcapngWriter) writeBlock(typ uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.LittleEndian, typ)
+	_ = binary.Write(&buf, binary.LittleEndian, length)
+	buf.Write(body)
+	_ = binary.Write(&buf, binary.LittleEndian, length)
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
+
+// writeSectionHeader writes the section header block to the file
+func (p *pcapngWriter) writeSectionHeader() error {
+	body := bytes.Buffer{}
+	_ = binary.Write(&body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	_ = binary.Write(&body, binary.LittleEndian, uint16(1)) // major
+	_ = binary.Write(&body, binary.LittleEndian, uint16(0)) // minor
+	_ = binary.Write(&body, binary.LittleEndian, int64(-1)) // length
+	return p.writeBlock(pcapngBlockTypeSectionHeader, body.Bytes())
+}
+
+// getInterface returns the id of the interface iface and writes an
+// interface description block to the file if the interface is new
+func (p *pcapngWriter) getInterface(iface pcapngInterface) (uint32, error) {
+	if id, ok := p.interfaces[iface]; ok {
+		return id, nil
+	}
+
+	body := bytes.Buffer{}
+	_ = binary.Write(&body, binary.LittleEndian,
+		uint16(pcapngLinkTypeEthernet))
+	_ = binary.Write(&body, binary.LittleEndian, uint16(0)) // reserved
+	_ = binary.Write(&body, binary.LittleEndian, uint32(0)) // snaplen
+	if iface.device != "" {
+		p.writeOption(&body, pcapngOptionIfName, []byte(iface.device))
+	}
+	p.writeOption(&body, pcapngOptionIfDescr,
+		[]byte(fmt.Sprintf("client %d", iface.client)))
+	p.writeOption(&body, pcapngOptionEndOfOpt, nil)
+	if err := p.writeBlock(pcapngBlockTypeInterfaceDescription,
+		body.Bytes()); err != nil {
+		return 0, err
+	}
+
+	id := uint32(len(p.interfaces))
+	p.interfaces[iface] = id
+	return id, nil
+}
+
+// writePacket writes packet captured on device of client at timestamp with
+// comment to the file
+func (p *pcapngWriter) writePacket(client uint8, device string,
+	timestamp time.Time, packet []byte, comment string) error {
+	id, err := p.getInterface(pcapngInterface{client, device})
+	if err != nil {
+		return err
+	}
+
+	// timestamps are in microseconds
+	ts := uint64(timestamp.UnixMicro())
+	body := bytes.Buffer{}
+	_ = binary.Write(&body, binary.LittleEndian, id)
+	_ = binary.Write(&body, binary.LittleEndian, uint32(ts>>32))
+	_ = binary.Write(&body, binary.LittleEndian, uint32(ts))
+	_ = binary.Write(&body, binary.LittleEndian, uint32(len(packet)))
+	_ = binary.Write(&body, binary.LittleEndian, uint32(len(packet)))
+	body.Write(packet)
+	body.Write(make([]byte, pcapngPad(len(packet))))
+	if comment != "" {
+		p.writeOption(&body, pcapngOptionComment, []byte(comment))
+		p.writeOption(&body, pcapngOptionEndOfOpt, nil)
+	}
+	return p.writeBlock(pcapngBlockTypeEnhancedPacket, body.Bytes())
+}
+
+// newPcapngWriter creates a new pcapng writer that writes to w
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{
+		w:          w,
+		interfaces: make(map[pcapngInterface]uint32),
+	}
+	if err := p.writeSectionHeader(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readPcapngBlocks reads the types and bodies of all blocks in b
+func readPcapngBlocks(t *testing.T, b []byte) ([]uint32, [][]byte) {
+	types := []uint32{}
+	bodies := [][]byte{}
+	for len(b) > 0 {
+		typ := binary.LittleEndian.Uint32(b[0:4])
+		length := binary.LittleEndian.Uint32(b[4:8])
+		if length%4 != 0 || int(length) > len(b) {
+			t.Fatalf("invalid block length %d", length)
+		}
+		if binary.LittleEndian.Uint32(b[length-4:length]) != length {
+			t.Fatalf("invalid trailing block length")
+		}
+		types = append(types, typ)
+		bodies = append(bodies, b[8:length-4])
+		b = b[length:]
+	}
+	return types, bodies
+}
+
+// TestPcapngWriter tests writing packets to a pcapng file
+func TestPcapngWriter(t *testing.T) {
+	// write packets
+	buf := &bytes.Buffer{}
+	w, err := newPcapngWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	timestamp := time.Unix(1700000000, 123456000)
+	for _, client := range []uint8{1, 2, 1} {
+		if err := w.writePacket(client, "veth2", timestamp, packet,
+			"item=0 side=sender"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// read blocks
+	types, bodies := readPcapngBlocks(t, buf.Bytes())
+
+	// check block types
+	want := []uint32{
+		pcapngBlockTypeSectionHeader,
+		pcapngBlockTypeInterfaceDescription,
+		pcapngBlockTypeEnhancedPacket,
+		pcapngBlockTypeInterfaceDescription,
+		pcapngBlockTypeEnhancedPacket,
+		pcapngBlockTypeEnhancedPacket,
+	}
+	if len(types) != len(want) {
+		t.Fatalf("got %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("got %v, want %v", types, want)
+		}
+	}
+
+	// check interface of second client
+	if !bytes.Contains(bodies[3], []byte("client 2")) {
+		t.Errorf("client not found in interface block")
+	}
+	if id := binary.LittleEndian.Uint32(bodies[5][0:4]); id != 0 {
+		t.Errorf("got interface %d, want %d", id, 0)
+	}
+
+	// check second packet block
+	body := bodies[4]
+	if id := binary.LittleEndian.Uint32(body[0:4]); id != 1 {
+		t.Errorf("got interface %d, want %d", id, 1)
+	}
+	ts := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 |
+		uint64(binary.LittleEndian.Uint32(body[8:12]))
+	if ts != uint64(timestamp.UnixMicro()) {
+		t.Errorf("got timestamp %d, want %d", ts, timestamp.UnixMicro())
+	}
+	if got := body[20 : 20+len(packet)]; !bytes.Equal(got, packet) {
+		t.Errorf("got %v, want %v", got, packet)
+	}
+	if !bytes.Contains(body, []byte("item=0 side=sender")) {
+		t.Errorf("comment not found in packet block")
+	}
+}
+
+// TestWritePcapFile tests writing the packets of a plan to a pcapng file
+func TestWritePcapFile(t *testing.T) {
+	// only send the first probe
+	plan := getExampleResultWriterPlan()
+	plan.items[0].SenderID = 1
+	plan.items[0].ReceiverID = 2
+	plan.items[0].SendTime = time.Unix(1700000000, 0)
+	plan.items[0].SenderMsg.SrcMAC = net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	plan.items[0].SenderMsg.DstMAC = net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	plan.items[0].ReceiverResults[0].Packet = []byte{1, 2, 3, 4}
+	plan.items[2].SenderResults[0].Packet = []byte{1, 2, 3, 4}
+
+	// write and read file
+	file := filepath.Join(t.TempDir(), "test.pcapng")
+	plan.writePcapFile(file)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, _ := readPcapngBlocks(t, b)
+
+	// check probe and receiver packet on interfaces of both clients
+	want := []uint32{
+		pcapngBlockTypeSectionHeader,
+		pcapngBlockTypeInterfaceDescription,
+		pcapngBlockTypeEnhancedPacket,
+		pcapngBlockTypeInterfaceDescription,
+		pcapngBlockTypeEnhancedPacket,
+	}
+	if len(types) != len(want) {
+		t.Fatalf("got %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("got %v, want %v", types, want)
+		}
+	}
+}
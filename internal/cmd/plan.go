@@ -2,11 +2,17 @@ package cmd
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
@@ -17,51 +23,119 @@ const (
 	planResultPass = iota
 	planResultReject
 	planResultDrop
+	planResultMissing
+	planResultError
+	planResultPassReject
+	planResultUnknown
 )
 
+// planResultString converts a plan result to a string
+func planResultString(result uint8) string {
+	switch result {
+	case planResultPass:
+		return "pass"
+	case planResultReject:
+		return "reject"
+	case planResultDrop:
+		return "drop"
+	case planResultMissing:
+		return "missing"
+	case planResultError:
+		return "error"
+	case planResultPassReject:
+		return "pass+reject"
+	case planResultUnknown:
+		return "unknown"
+	}
+	return ""
+}
+
+// parsePlanResult converts a string to a plan result
+func parsePlanResult(s string) (uint8, bool) {
+	for _, r := range []uint8{
+		planResultPass,
+		planResultReject,
+		planResultDrop,
+	} {
+		if planResultString(r) == s {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// portRangeString converts the port range from first to last to a string
+func portRangeString(first, last uint16) string {
+	if first == last {
+		return fmt.Sprintf("%d", first)
+	}
+	return fmt.Sprintf("%d:%d", first, last)
+}
+
 // planResultRange is a port range with the same plan result
 type planResultRange struct {
+	flow      string
 	result    uint8
+	reason    string
 	firstPort uint16
 	lastPort  uint16
 }
 
+// verdict returns the plan result of the range including its reason, e.g.,
+// "reject: tcp-reset"
+func (r *planResultRange) verdict() string {
+	if r.reason == "" {
+		return planResultString(r.result)
+	}
+	return planResultString(r.result) + ": " + r.reason
+}
+
 // planResults is a collection of results of a completed plan for printing
 type planResults struct {
 	ranges []*planResultRange
 }
 
+// hasFlows checks if planResults contains results of multiple flows
+func (p *planResults) hasFlows() bool {
+	for _, r := range p.ranges {
+		if r.flow != p.ranges[0].flow {
+			return true
+		}
+	}
+	return false
+}
+
 // String converts planResults to a string
 func (p *planResults) String() string {
 	s := ""
+	flow := ""
+	hasFlows := p.hasFlows()
 	for _, r := range p.ranges {
-		if r.firstPort == r.lastPort {
-			s += fmt.Sprintf("%d\t", r.firstPort)
-		} else {
-			s += fmt.Sprintf("%d:%d\t", r.firstPort, r.lastPort)
-		}
-		switch r.result {
-		case planResultPass:
-			s += fmt.Sprintf("pass\n")
-		case planResultReject:
-			s += fmt.Sprintf("reject\n")
-		case planResultDrop:
-			s += fmt.Sprintf("drop\n")
+		if hasFlows && r.flow != flow {
+			flow = r.flow
+			s += fmt.Sprintf("%s\n", flow)
 		}
+		s += fmt.Sprintf("%s\t%s\n", portRangeString(r.firstPort,
+			r.lastPort), r.verdict())
 	}
 	return s
 }
 
-// add adds r to the collection of results; expects results added with
-// increasing port numbers, without gaps
-func (p *planResults) add(port uint16, result uint8) {
+// add adds the result and its reason to the collection of results; expects
+// results added with increasing port numbers per flow
+func (p *planResults) add(flow string, port uint16, result uint8,
+	reason string) {
 	if length := len(p.ranges); length > 0 &&
+		p.ranges[length-1].flow == flow &&
 		p.ranges[length-1].result == result &&
+		p.ranges[length-1].reason == reason &&
 		p.ranges[length-1].lastPort == port-1 {
 		p.ranges[length-1].lastPort = port
 	} else {
 		newRange := &planResultRange{
+			flow:      flow,
 			result:    result,
+			reason:    reason,
 			firstPort: port,
 			lastPort:  port,
 		}
@@ -69,6 +143,53 @@ func (p *planResults) add(port uint16, result uint8) {
 	}
 }
 
+// planHopRange is a port range with the same hop result
+type planHopRange struct {
+	flow      string
+	result    string
+	firstPort uint16
+	lastPort  uint16
+}
+
+// planHopResults is a collection of hop results of a completed plan for
+// printing
+type planHopResults struct {
+	ranges []*planHopRange
+}
+
+// String converts planHopResults to a string
+func (p *planHopResults) String() string {
+	s := ""
+	flow := ""
+	for _, r := range p.ranges {
+		if r.flow != flow {
+			flow = r.flow
+			s += fmt.Sprintf("%s\n", flow)
+		}
+		s += fmt.Sprintf("%s\t%s\n", portRangeString(r.firstPort,
+			r.lastPort), r.result)
+	}
+	return s
+}
+
+// add adds the hop result to the collection of hop results; expects results
+// added with increasing port numbers per flow
+func (p *planHopResults) add(flow string, port uint16, result string) {
+	if length := len(p.ranges); length > 0 &&
+		p.ranges[length-1].flow == flow &&
+		p.ranges[length-1].result == result &&
+		p.ranges[length-1].lastPort == port-1 {
+		p.ranges[length-1].lastPort = port
+		return
+	}
+	p.ranges = append(p.ranges, &planHopRange{
+		flow:      flow,
+		result:    result,
+		firstPort: port,
+		lastPort:  port,
+	})
+}
+
 // planPacketDiff is a difference in packet fields
 type planPacketDiff struct {
 	Field    string
@@ -112,77 +233,284 @@ func (p *planPacketDiffs) String() string {
 	return s
 }
 
+// planHop is an intermediate receiver of a plan item between the sender and
+// the receiver, e.g., between two chained middleboxes
+type planHop struct {
+	ReceiverID      uint8
+	ReceiverMsg     *MessageTest
+	receiverReady   bool
+	ReceiverResults []*MessageResult
+	PacketDiffs     planPacketDiffs
+}
+
+// containsPass checks if the hop contains a passing result
+func (h *planHop) containsPass() bool {
+	for _, r := range h.ReceiverResults {
+		if r.Result == ResultPass {
+			return true
+		}
+	}
+	return false
+}
+
 // planItem is a specific test in a test execution plan
 type planItem struct {
 	ID              uint32
 	Port            uint16
+	SenderID        uint8
+	ReceiverID      uint8
 	SenderMsg       *MessageTest
 	ReceiverMsg     *MessageTest
 	receiverReady   bool
 	SenderResults   []*MessageResult
 	ReceiverResults []*MessageResult
 	PacketDiffs     planPacketDiffs
+	Hops            []*planHop `json:",omitempty"`
+	Expected        string
+	SendTime        time.Time
+	dispatchTime    time.Time
+	queue           *planQueue
+}
+
+// isFirewalk checks if plan item is a firewalk probe, i.e., a probe without
+// receiver that expires behind the middlebox
+func (p *planItem) isFirewalk() bool {
+	return p.ReceiverMsg == nil && p.SenderMsg.TTL != 0
 }
 
-// containsPass checks if plan item contains a passing result
+// containsPass checks if plan item contains a passing result; firewalk
+// probes pass if they expire behind the middlebox
 func (p *planItem) containsPass() bool {
 	for _, r := range p.ReceiverResults {
 		if r.Result == ResultPass {
 			return true
 		}
-		log.Println("other result:", r)
+	}
+	if p.isFirewalk() {
+		for _, r := range p.SenderResults {
+			if isTimeExceeded(r.Result) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isReject checks if result is a reject result, e.g., an icmp error or a tcp
+// reset
+func isReject(result uint8) bool {
+	switch result {
+	case ResultICMPv4NetworkUnreachable,
+		ResultICMPv4HostUnreachable,
+		ResultICMPv4ProtocolUnreachable,
+		ResultICMPv4PortUnreachable,
+		ResultICMPv4FragmentationNeeded,
+		ResultICMPv4SourceRoutingFailed,
+		ResultICMPv4NetworkUnknown,
+		ResultICMPv4HostUnknown,
+		ResultICMPv4SourceIsolated,
+		ResultICMPv4NetworkProhibited,
+		ResultICMPv4HostProhibited,
+		ResultICMPv4NetworkTOS,
+		ResultICMPv4HostTOS,
+		ResultICMPv4CommProhibited,
+		ResultICMPv4HostPrecedence,
+		ResultICMPv4PrecedenceCutoff,
+		ResultICMPv6NoRouteToDst,
+		ResultICMPv6AdminProhibited,
+		ResultICMPv6BeyondScopeOfSrc,
+		ResultICMPv6AddressUnreachable,
+		ResultICMPv6PortUnreachable,
+		ResultICMPv6SrcAddressFailed,
+		ResultICMPv6RejectRouteToDst,
+		ResultICMPv6SrcRoutingHeader,
+		ResultICMPv6HeadersTooLong,
+		ResultTCPReset:
+		return true
 	}
 	return false
 }
 
+// isPathError checks if result is an icmp error that reports a problem on
+// the path rather than a reject of the packet, e.g., an expired ttl or a
+// packet too big for the mtu
+func isPathError(result uint8) bool {
+	switch result {
+	case ResultICMPv4TTLExceeded,
+		ResultICMPv4ReassemblyExceeded,
+		ResultICMPv4ParameterProblem,
+		ResultICMPv6PacketTooBig,
+		ResultICMPv6HopLimitExceeded,
+		ResultICMPv6ReassemblyExceeded,
+		ResultICMPv6ParameterProblem:
+		return true
+	}
+	return false
+}
+
+// isError checks if result is an error result of a client
+func isError(result uint8) bool {
+	return result == ResultError || result == ResultTimeout
+}
+
 // containsReject checks if plan item contains a rejected result
 func (p *planItem) containsReject() bool {
 	for _, r := range p.SenderResults {
-		switch r.Result {
-		case ResultICMPv4NetworkUnreachable,
-			ResultICMPv4HostUnreachable,
-			ResultICMPv4ProtocolUnreachable,
-			ResultICMPv4PortUnreachable,
-			ResultICMPv4FragmentationNeeded,
-			ResultICMPv4SourceRoutingFailed,
-			ResultICMPv4NetworkUnknown,
-			ResultICMPv4HostUnknown,
-			ResultICMPv4SourceIsolated,
-			ResultICMPv4NetworkProhibited,
-			ResultICMPv4HostProhibited,
-			ResultICMPv4NetworkTOS,
-			ResultICMPv4HostTOS,
-			ResultICMPv4CommProhibited,
-			ResultICMPv4HostPrecedence,
-			ResultICMPv4PrecedenceCutoff,
-			ResultICMPv6NoRouteToDst,
-			ResultICMPv6AdminProhibited,
-			ResultICMPv6BeyondScopeOfSrc,
-			ResultICMPv6AddressUnreachable,
-			ResultICMPv6PortUnreachable,
-			ResultICMPv6SrcAddressFailed,
-			ResultICMPv6RejectRouteToDst,
-			ResultICMPv6SrcRoutingHeader,
-			ResultICMPv6HeadersTooLong,
-			ResultTCPReset:
+		if isReject(r.Result) {
 			return true
-		default:
-			log.Println("other result:", r)
 		}
 	}
 	return false
 }
 
+// containsError checks if plan item contains an error result
+func (p *planItem) containsError() bool {
+	for _, r := range slices.Concat(p.SenderResults, p.ReceiverResults) {
+		if isError(r.Result) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInfo checks if result is an informational result that does not affect
+// the plan result, e.g., an icmp redirect
+func isInfo(result uint8) bool {
+	return result == ResultICMPv4Redirect || result == ResultICMPv6Redirect
+}
+
 // containsDrop checks if plan item contains a dropped result
 func (p *planItem) containsDrop() bool {
-	if len(p.ReceiverResults) == 0 && len(p.SenderResults) == 0 {
-		return true
+	for _, r := range slices.Concat(p.SenderResults, p.ReceiverResults) {
+		if !isInfo(r.Result) {
+			return false
+		}
 	}
-	return false
+	return true
+}
+
+// getResult returns the plan result of the plan item
+func (p *planItem) getResult() uint8 {
+	pass := p.containsPass()
+	reject := p.containsReject()
+	switch {
+	case pass && reject:
+		return planResultPassReject
+	case pass:
+		return planResultPass
+	case reject:
+		return planResultReject
+	case p.containsError():
+		return planResultError
+	case p.containsDrop():
+		return planResultDrop
+	}
+	return planResultUnknown
+}
+
+// getReason returns the distinct reject, error or path error results that
+// lead to the plan result of the plan item, e.g., "tcp-reset"
+func (p *planItem) getReason() string {
+	match := isReject
+	switch p.getResult() {
+	case planResultReject, planResultPassReject:
+	case planResultError:
+		match = isError
+	case planResultUnknown:
+		match = isPathError
+	default:
+		return ""
+	}
+	reasons := []string{}
+	for _, r := range p.SenderResults {
+		if match(r.Result) &&
+			!slices.Contains(reasons, resultString(r.Result)) {
+			reasons = append(reasons, resultString(r.Result))
+		}
+	}
+	for _, r := range p.ReceiverResults {
+		if match(r.Result) &&
+			!slices.Contains(reasons, resultString(r.Result)) {
+			reasons = append(reasons, resultString(r.Result))
+		}
+	}
+	return strings.Join(reasons, ",")
+}
+
+// getFlow returns the protocol and ip addresses of the plan item as string
+func (p *planItem) getFlow() string {
+	flow := fmt.Sprintf("%s %s -> %s", protocolString(p.SenderMsg.Protocol),
+		p.SenderMsg.SrcIP, p.SenderMsg.DstIP)
+	if p.SenderMsg.Malform != "" {
+		flow += fmt.Sprintf(" (%s)", p.SenderMsg.Malform)
+	}
+	return flow
+}
+
+// getHop returns the hop of the plan item with clientID as receiver
+func (p *planItem) getHop(clientID uint8) *planHop {
+	for _, h := range p.Hops {
+		if h.ReceiverID == clientID {
+			return h
+		}
+	}
+	return nil
+}
+
+// isReady checks if the receiver and all hops of the plan item are ready
+func (p *planItem) isReady() bool {
+	for _, h := range p.Hops {
+		if !h.receiverReady {
+			return false
+		}
+	}
+	return p.receiverReady
+}
+
+// getPath returns the hops and the receiver of the plan item in the order
+// from the sender to the receiver
+func (p *planItem) getPath() []*planHop {
+	path := append([]*planHop{}, p.Hops...)
+	return append(path, &planHop{
+		ReceiverID:      p.ReceiverID,
+		ReceiverMsg:     p.ReceiverMsg,
+		ReceiverResults: p.ReceiverResults,
+		PacketDiffs:     p.PacketDiffs,
+	})
+}
+
+// getHopResult returns at which hops the probe of the plan item was
+// rewritten and at which hop it was dropped or rejected
+func (p *planItem) getHopResult() string {
+	results := []string{}
+	diffs := ""
+	for i, h := range p.getPath() {
+		hop := fmt.Sprintf("hop %d (client %d, %s)", i+1, h.ReceiverID,
+			h.ReceiverMsg.Device)
+		if !h.containsPass() {
+			verdict := "dropped"
+			if p.containsReject() {
+				verdict = "rejected"
+			}
+			results = append(results, fmt.Sprintf("%s before %s",
+				verdict, hop))
+			break
+		}
+		if d := h.PacketDiffs.String(); d != diffs {
+			results = append(results, fmt.Sprintf(
+				"rewritten before %s", hop))
+			diffs = d
+		}
+	}
+	if len(results) == 0 {
+		return "passed all hops"
+	}
+	return strings.Join(results, ", ")
 }
 
 // getEthernetDiffs gets differences in ethernet fields
-func (p *planItem) getEthernetDiffs(packet gopacket.Packet) {
+func (p *planItem) getEthernetDiffs(diffs *planPacketDiffs,
+	packet gopacket.Packet) {
 	// get ethernet header
 	ethLayer := packet.Layer(layers.LayerTypeEthernet)
 	if ethLayer == nil {
@@ -192,14 +520,14 @@ func (p *planItem) getEthernetDiffs(packet gopacket.Packet) {
 
 	// check mac addresses
 	if p.SenderMsg.SrcMAC != nil && !bytes.Equal(eth.SrcMAC, p.SenderMsg.SrcMAC) {
-		p.PacketDiffs.add(
+		diffs.add(
 			"SrcMAC",
 			fmt.Sprintf("%s", p.SenderMsg.SrcMAC),
 			fmt.Sprintf("%s", eth.SrcMAC),
 		)
 	}
 	if p.SenderMsg.DstMAC != nil && !bytes.Equal(eth.DstMAC, p.SenderMsg.DstMAC) {
-		p.PacketDiffs.add(
+		diffs.add(
 			"DstMAC",
 			fmt.Sprintf("%s", p.SenderMsg.DstMAC),
 			fmt.Sprintf("%s", eth.DstMAC),
@@ -208,16 +536,17 @@ func (p *planItem) getEthernetDiffs(packet gopacket.Packet) {
 }
 
 // getIPAddrDiffs gets differences in ip addresses
-func (p *planItem) getIPAddrDiffs(src, dst net.IP) {
-	if p.SenderMsg.SrcIP != nil && !p.SenderMsg.SrcIP.Equal(src) {
-		p.PacketDiffs.add(
+func (p *planItem) getIPAddrDiffs(diffs *planPacketDiffs, src, dst net.IP) {
+	sent := getMalformSrcIP(p.SenderMsg)
+	if sent != nil && !sent.Equal(src) {
+		diffs.add(
 			"SrcIP",
-			fmt.Sprintf("%s", p.SenderMsg.SrcIP),
+			fmt.Sprintf("%s", sent),
 			fmt.Sprintf("%s", src),
 		)
 	}
 	if p.SenderMsg.DstIP != nil && !p.SenderMsg.DstIP.Equal(dst) {
-		p.PacketDiffs.add(
+		diffs.add(
 			"DstIP",
 			fmt.Sprintf("%s", p.SenderMsg.DstIP),
 			fmt.Sprintf("%s", dst),
@@ -226,36 +555,38 @@ func (p *planItem) getIPAddrDiffs(src, dst net.IP) {
 }
 
 // getIPv4Diffs gets differences in ipv4 fields
-func (p *planItem) getIPv4Diffs(packet gopacket.Packet) {
+func (p *planItem) getIPv4Diffs(diffs *planPacketDiffs,
+	packet gopacket.Packet) {
 	ipLayer := packet.Layer(layers.LayerTypeIPv4)
 	if ipLayer == nil {
 		return
 	}
 	ip, _ := ipLayer.(*layers.IPv4)
-	p.getIPAddrDiffs(ip.SrcIP, ip.DstIP)
+	p.getIPAddrDiffs(diffs, ip.SrcIP, ip.DstIP)
 }
 
 // getIPv6fDiffs getss differences in ipv6 fields
-func (p *planItem) getIPv6Diffs(packet gopacket.Packet) {
+func (p *planItem) getIPv6Diffs(diffs *planPacketDiffs,
+	packet gopacket.Packet) {
 	ipLayer := packet.Layer(layers.LayerTypeIPv6)
 	if ipLayer == nil {
 		return
 	}
 	ip, _ := ipLayer.(*layers.IPv6)
-	p.getIPAddrDiffs(ip.SrcIP, ip.DstIP)
+	p.getIPAddrDiffs(diffs, ip.SrcIP, ip.DstIP)
 }
 
 // getIPDiffs gets differences in ip fields
-func (p *planItem) getIPDiffs(packet gopacket.Packet) {
+func (p *planItem) getIPDiffs(diffs *planPacketDiffs, packet gopacket.Packet) {
 	ip4Layer := packet.Layer(layers.LayerTypeIPv4)
 	if ip4Layer != nil {
-		p.getIPv4Diffs(packet)
+		p.getIPv4Diffs(diffs, packet)
 		return
 	}
 
 	ip6Layer := packet.Layer(layers.LayerTypeIPv6)
 	if ip6Layer != nil {
-		p.getIPv6Diffs(packet)
+		p.getIPv6Diffs(diffs, packet)
 		return
 	}
 
@@ -263,16 +594,16 @@ func (p *planItem) getIPDiffs(packet gopacket.Packet) {
 }
 
 // getPortDiffs gets differences in port numbers
-func (p *planItem) getPortDiffs(src, dst uint16) {
-	if p.SenderMsg.SrcPort != src {
-		p.PacketDiffs.add(
+func (p *planItem) getPortDiffs(diffs *planPacketDiffs, src, dst uint16) {
+	if sent := getMalformSrcPort(p.SenderMsg); sent != src {
+		diffs.add(
 			"SrcPort",
-			fmt.Sprintf("%d", p.SenderMsg.SrcPort),
+			fmt.Sprintf("%d", sent),
 			fmt.Sprintf("%d", src),
 		)
 	}
 	if p.SenderMsg.DstPort != dst {
-		p.PacketDiffs.add(
+		diffs.add(
 			"DstPort",
 			fmt.Sprintf("%d", p.SenderMsg.DstPort),
 			fmt.Sprintf("%d", dst),
@@ -281,7 +612,7 @@ func (p *planItem) getPortDiffs(src, dst uint16) {
 }
 
 // getTCPDiffs gets differences in tcp fields
-func (p *planItem) getTCPDiffs(packet gopacket.Packet) {
+func (p *planItem) getTCPDiffs(diffs *planPacketDiffs, packet gopacket.Packet) {
 	// get tcp header
 	tcpLayer := packet.Layer(layers.LayerTypeTCP)
 	if tcpLayer == nil {
@@ -290,11 +621,11 @@ func (p *planItem) getTCPDiffs(packet gopacket.Packet) {
 	tcp, _ := tcpLayer.(*layers.TCP)
 
 	// check ports
-	p.getPortDiffs(uint16(tcp.SrcPort), uint16(tcp.DstPort))
+	p.getPortDiffs(diffs, uint16(tcp.SrcPort), uint16(tcp.DstPort))
 }
 
 // getUDPDiffs gets differences in udp fields
-func (p *planItem) getUDPDiffs(packet gopacket.Packet) {
+func (p *planItem) getUDPDiffs(diffs *planPacketDiffs, packet gopacket.Packet) {
 	// get udp header
 	udpLayer := packet.Layer(layers.LayerTypeUDP)
 	if udpLayer == nil {
@@ -303,33 +634,35 @@ func (p *planItem) getUDPDiffs(packet gopacket.Packet) {
 	udp, _ := udpLayer.(*layers.UDP)
 
 	// check ports
-	p.getPortDiffs(uint16(udp.SrcPort), uint16(udp.DstPort))
+	p.getPortDiffs(diffs, uint16(udp.SrcPort), uint16(udp.DstPort))
 }
 
 // getL4Diffs gets differences in l4 fields
-func (p *planItem) getL4Diffs(packet gopacket.Packet) {
+func (p *planItem) getL4Diffs(diffs *planPacketDiffs, packet gopacket.Packet) {
 	// check tcp
 	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		p.getTCPDiffs(packet)
+		p.getTCPDiffs(diffs, packet)
 		return
 	}
 
 	// check udp
 	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-		p.getUDPDiffs(packet)
+		p.getUDPDiffs(diffs, packet)
 		return
 	}
 
 	log.Println("packet does not contain expected l4 header")
 }
 
-func (p *planItem) getPacketDiffs(packet []byte) {
+// getPacketDiffs gets differences between the sent packet and the received
+// packet and adds them to diffs
+func (p *planItem) getPacketDiffs(diffs *planPacketDiffs, packet []byte) {
 	pkt := gopacket.NewPacket(packet, layers.LayerTypeEthernet,
 		gopacket.Default)
 
-	p.getEthernetDiffs(pkt)
-	p.getIPDiffs(pkt)
-	p.getL4Diffs(pkt)
+	p.getEthernetDiffs(diffs, pkt)
+	p.getIPDiffs(diffs, pkt)
+	p.getL4Diffs(diffs, pkt)
 }
 
 // printPacketDiffs prints differences in packet fields
@@ -350,43 +683,140 @@ func newPlanItem(id uint32, port uint16, senderMsg, receiverMsg *MessageTest) *p
 	}
 }
 
+// planQueue is a queue of plan items with the same sender and receiver
+// clients; the items in a queue are run one after another, while the queues
+// of a plan are run independently. The generation is increased when the
+// current item is restarted, so pending moves to the next item are ignored
+type planQueue struct {
+	senderID   uint8
+	receiverID uint8
+	hopIDs     []uint8
+	items      []*planItem
+	current    int
+	started    bool
+	generation uint32
+}
+
+// hasClient checks if clientID is the sender, receiver or a hop of the
+// queue
+func (q *planQueue) hasClient(clientID uint8) bool {
+	return q.senderID == clientID || q.receiverID == clientID ||
+		slices.Contains(q.hopIDs, clientID)
+}
+
+// getCurrentItem returns the current plan item of the queue
+func (q *planQueue) getCurrentItem() *planItem {
+	if q.current >= len(q.items) {
+		return nil
+	}
+	return q.items[q.current]
+}
+
+// restartCurrentItem resets the current plan item of the queue, so it can be
+// dispatched to the clients again, and returns it
+func (q *planQueue) restartCurrentItem() *planItem {
+	item := q.getCurrentItem()
+	if item == nil {
+		return nil
+	}
+	q.generation++
+	item.receiverReady = false
+	item.SenderResults = nil
+	item.ReceiverResults = nil
+	item.PacketDiffs = nil
+	item.SendTime = time.Time{}
+	for _, h := range item.Hops {
+		h.receiverReady = false
+		h.ReceiverResults = nil
+		h.PacketDiffs = nil
+	}
+	return item
+}
+
+// isCurrentItemSent checks if the sender test of the current plan item of
+// the queue was sent; the queue then moves on to the next item
+func (q *planQueue) isCurrentItemSent() bool {
+	item := q.getCurrentItem()
+	return item != nil && !item.SendTime.IsZero()
+}
+
+// getNextItem returns the next plan item of the queue
+func (q *planQueue) getNextItem() *planItem {
+	q.current++
+	return q.getCurrentItem()
+}
+
 // plan is a test execution plan
 type plan struct {
-	senderID       uint8
-	receiverID     uint8
-	items          map[uint32]*planItem
-	currentItem    uint32
-	senderActive   bool
-	receiverActive bool
+	items  map[uint32]*planItem
+	queues []*planQueue
+	active map[uint8]bool
+}
+
+// setClients sets the sender and receiver clients of all plan items without
+// clients to senderID and receiverID; plan items without receiver test do not
+// get a receiver
+func (p *plan) setClients(senderID, receiverID uint8) {
+	for _, item := range p.items {
+		if item.SenderID == 0 {
+			item.SenderID = senderID
+		}
+		if item.ReceiverID == 0 && item.ReceiverMsg != nil {
+			item.ReceiverID = receiverID
+		}
+	}
+}
+
+// schedule creates the queues of all sender and receiver pairs in the plan
+func (p *plan) schedule() {
+	p.queues = nil
+	p.active = make(map[uint8]bool)
+	queues := make(map[[2]uint8]*planQueue)
+	for i := uint32(0); p.items[i] != nil; i++ {
+		item := p.items[i]
+		pair := [2]uint8{item.SenderID, item.ReceiverID}
+		q := queues[pair]
+		if q == nil {
+			q = &planQueue{
+				senderID:   item.SenderID,
+				receiverID: item.ReceiverID,
+			}
+			queues[pair] = q
+			p.queues = append(p.queues, q)
+		}
+		for _, h := range item.Hops {
+			if !slices.Contains(q.hopIDs, h.ReceiverID) {
+				q.hopIDs = append(q.hopIDs, h.ReceiverID)
+			}
+		}
+		q.items = append(q.items, item)
+		item.queue = q
+	}
 }
 
 // isSender checks if clientID is in the senders list
 func (p *plan) isSender(clientID uint8) bool {
-	if p.senderID == clientID {
-		return true
+	for _, q := range p.queues {
+		if q.senderID == clientID {
+			return true
+		}
 	}
 	return false
 }
 
-// isReceiver checks if clientID is in the receivers list
+// isReceiver checks if clientID is in the receivers or hops list
 func (p *plan) isReceiver(clientID uint8) bool {
-	if p.receiverID == clientID {
-		return true
+	for _, q := range p.queues {
+		if q.receiverID == clientID ||
+			slices.Contains(q.hopIDs, clientID) {
+			return true
+		}
 	}
 	return false
 }
 
 // handleResult handles result coming from clientID
 func (p *plan) handleResult(clientID uint8, result *MessageResult) {
-	// check if client is a sender or receiver
-	isSender := p.isSender(clientID)
-	if !isSender {
-		if !p.isReceiver(clientID) {
-			log.Println("Received result from invalid client")
-			return
-		}
-	}
-
 	// get plan item
 	item := p.items[result.ID]
 	if item == nil {
@@ -394,6 +824,29 @@ func (p *plan) handleResult(clientID uint8, result *MessageResult) {
 		return
 	}
 
+	// check if client is the sender or receiver of the item; if the
+	// client is both, the role in the result decides
+	isSender := item.SenderID == clientID
+	isReceiver := item.ReceiverID == clientID
+	hop := item.getHop(clientID)
+	switch result.Role {
+	case RoleSender:
+		isReceiver = false
+		hop = nil
+	case RoleReceiver:
+		isSender = false
+	}
+	if !isSender && !isReceiver && hop == nil {
+		log.Println("Received result from invalid client")
+		return
+	}
+
+	// add result to hop's result list
+	if !isSender && !isReceiver {
+		hop.handleResult(item, clientID, result)
+		return
+	}
+
 	// add result to result list
 	if isSender {
 		item.SenderResults = append(item.SenderResults, result)
@@ -410,7 +863,7 @@ func (p *plan) handleResult(clientID uint8, result *MessageResult) {
 
 		if result.Result == ResultPass {
 			// handle "pass" results
-			item.getPacketDiffs(result.Packet)
+			item.getPacketDiffs(&item.PacketDiffs, result.Packet)
 		}
 
 		// handle other results
@@ -418,94 +871,517 @@ func (p *plan) handleResult(clientID uint8, result *MessageResult) {
 	}
 }
 
-// handleClient handles a new client
-func (p *plan) handleClient(clientID uint8) {
-	// is client the sender?
-	if clientID == p.senderID {
-		if p.senderActive {
-			log.Println("Sender client already active")
+// handleResult handles result of plan item coming from clientID
+func (h *planHop) handleResult(item *planItem, clientID uint8,
+	result *MessageResult) {
+	switch result.Result {
+	case ResultReady:
+		// handle "ready" results
+		if h.receiverReady {
+			log.Println("Double ready from client", clientID)
+			return
 		}
-		p.senderActive = true
+		h.receiverReady = true
 		return
+	case ResultPass:
+		// handle "pass" results
+		item.getPacketDiffs(&h.PacketDiffs, result.Packet)
 	}
 
-	// is client the receiver?
-	if clientID == p.receiverID {
-		if p.receiverActive {
-			log.Println("Receiver client already active")
+	// handle other results
+	h.ReceiverResults = append(h.ReceiverResults, result)
+}
+
+// checkTest checks if the client capabilities in reg support test
+func (p *plan) checkTest(test *MessageTest, reg *MessageRegister) error {
+	// legacy clients do not report their interfaces
+	if test.Device != "" && reg.Version != ProtocolVersionLegacy &&
+		reg.getInterface(test.Device) == nil {
+		return fmt.Errorf("device %s not found", test.Device)
+	}
+	if test.Protocol != ProtocolNone && !reg.hasProtocol(test.Protocol) {
+		return fmt.Errorf("protocol %s not supported",
+			protocolString(test.Protocol))
+	}
+	if test.TTL != 0 && !reg.hasFeature(FeatureTTL) {
+		return fmt.Errorf("ttl not supported")
+	}
+	if test.Malform != "" && !reg.hasFeature(FeatureMalform) {
+		return fmt.Errorf("malformed packets not supported")
+	}
+	return nil
+}
+
+// checkClient checks if the client capabilities in reg support the role of
+// clientID in the plan
+func (p *plan) checkClient(clientID uint8, reg *MessageRegister) error {
+	isSender := p.isSender(clientID)
+	isReceiver := p.isReceiver(clientID)
+	if !isSender && !isReceiver {
+		return fmt.Errorf("client %d is not part of the plan", clientID)
+	}
+	if isSender && !reg.hasFeature(FeatureSender) {
+		return fmt.Errorf("sender not supported")
+	}
+	if isReceiver && !reg.hasFeature(FeatureReceiver) {
+		return fmt.Errorf("receiver not supported")
+	}
+	for i := uint32(0); p.items[i] != nil; i++ {
+		item := p.items[i]
+		if item.SenderID == clientID {
+			if err := p.checkTest(item.SenderMsg, reg); err != nil {
+				return err
+			}
+		}
+		if item.ReceiverID == clientID {
+			if err := p.checkTest(item.ReceiverMsg, reg); err != nil {
+				return err
+			}
+		}
+		if h := item.getHop(clientID); h != nil {
+			if err := p.checkTest(h.ReceiverMsg, reg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleClient handles a new or returning client
+func (p *plan) handleClient(clientID uint8) {
+	p.active[clientID] = true
+}
+
+// setRun sets the plan run id in all test messages of the plan
+func (p *plan) setRun(id uint32) {
+	for _, item := range p.items {
+		item.SenderMsg.Run = id
+		if item.ReceiverMsg != nil {
+			item.ReceiverMsg.Run = id
+		}
+		for _, h := range item.Hops {
+			h.ReceiverMsg.Run = id
 		}
-		p.receiverActive = true
-		return
 	}
+}
 
-	// invalid client
-	log.Println("Invalid client")
+// handleClientLost handles a client that lost its connection; the current
+// plan items of the client are marked as errored, until they are restarted
+func (p *plan) handleClientLost(clientID uint8) {
+	for _, q := range p.getQueues(clientID) {
+		item := q.getCurrentItem()
+		if item == nil {
+			continue
+		}
+		result := &MessageResult{
+			ID:     item.ID,
+			Result: ResultError,
+			Time:   time.Now(),
+		}
+		if item.SenderID == clientID {
+			item.SenderResults = append(item.SenderResults, result)
+		}
+		if item.ReceiverID == clientID {
+			item.ReceiverResults = append(item.ReceiverResults,
+				result)
+		}
+		if h := item.getHop(clientID); h != nil {
+			h.ReceiverResults = append(h.ReceiverResults, result)
+		}
+	}
+	p.active[clientID] = false
+}
+
+// getQueues returns the queues with clientID as sender or receiver
+func (p *plan) getQueues(clientID uint8) []*planQueue {
+	queues := []*planQueue{}
+	for _, q := range p.queues {
+		if q.hasClient(clientID) {
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+// queueActive checks if the sender, receiver and hop clients of q are
+// active
+func (p *plan) queueActive(q *planQueue) bool {
+	for _, id := range q.hopIDs {
+		if !p.active[id] {
+			return false
+		}
+	}
+	return p.active[q.senderID] &&
+		(q.receiverID == 0 || p.active[q.receiverID])
 }
 
 // clientsActive checks if all clients are active
 func (p *plan) clientsActive() bool {
-	if p.senderActive && p.receiverActive {
-		return true
+	for _, q := range p.queues {
+		if !p.queueActive(q) {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
-// getCurrentItem returns the current plan item
-func (p *plan) getCurrentItem() *planItem {
-	return p.items[p.currentItem]
+// isDone checks if all queues reached the end of their items
+func (p *plan) isDone() bool {
+	for _, q := range p.queues {
+		if q.getCurrentItem() != nil {
+			return false
+		}
+	}
+	return true
 }
 
-// getNextItem returns the next plan item
-func (p *plan) getNextItem() *planItem {
-	p.currentItem++
-	return p.items[p.currentItem]
+// check checks if the plan items are complete and can be run
+func (p *plan) check() error {
+	if len(p.items) == 0 {
+		return errors.New("no items in plan")
+	}
+	for i := uint32(0); i < uint32(len(p.items)); i++ {
+		item := p.items[i]
+		if item == nil {
+			return fmt.Errorf("missing plan item %d", i)
+		}
+		if item.ID != i {
+			return fmt.Errorf("invalid id of plan item %d", i)
+		}
+		// only firewalk items do not have a receiver test
+		if item.SenderMsg == nil || (item.ReceiverMsg == nil &&
+			(!item.isFirewalk() || len(item.Hops) > 0)) {
+			return fmt.Errorf("missing tests in plan item %d", i)
+		}
+		for _, h := range item.Hops {
+			if h.ReceiverMsg == nil {
+				return fmt.Errorf("missing hop tests in plan "+
+					"item %d", i)
+			}
+		}
+	}
+	return nil
 }
 
-// printResults prints results of this plan to the console
-func (p *plan) printResults() {
+// getCompletedResults returns the results of all completed plan items; of
+// ttl sweeps, only the last probe is included
+func (p *plan) getCompletedResults() *planResults {
+	items := []*planItem{}
+	for _, q := range p.queues {
+		items = append(items, q.items[:min(q.current, len(q.items))]...)
+	}
+	slices.SortFunc(items, func(a, b *planItem) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	results := &planResults{}
+	for _, item := range items {
+		if p.isSweepProbe(item) {
+			continue
+		}
+		results.add(item.getFlow(), item.Port, item.getResult(),
+			item.getReason())
+	}
+	return results
+}
+
+// getProgress returns the number of finished plan items
+func (p *plan) getProgress() int {
+	done := 0
+	for _, q := range p.queues {
+		done += min(q.current, len(q.items))
+	}
+	return done
+}
+
+// getClients returns the ids of all senders, receivers and hops in the plan
+func (p *plan) getClients() []uint8 {
+	clients := []uint8{}
+	for _, q := range p.queues {
+		ids := append([]uint8{q.senderID, q.receiverID}, q.hopIDs...)
+		for _, id := range ids {
+			if id != 0 && !slices.Contains(clients, id) {
+				clients = append(clients, id)
+			}
+		}
+	}
+	slices.Sort(clients)
+	return clients
+}
+
+// hasClient checks if clientID is a sender, receiver or hop in the plan
+func (p *plan) hasClient(clientID uint8) bool {
+	return p.isSender(clientID) || p.isReceiver(clientID)
+}
+
+// getResults returns the results of this plan; of ttl sweeps, only the last
+// probe is included
+func (p *plan) getResults() *planResults {
 	i := uint32(0)
-	results := planResults{}
+	results := &planResults{}
 	for {
 		item := p.items[i]
 		if item == nil {
 			break
 		}
 
-		switch {
-		case item.containsPass():
-			results.add(item.Port, planResultPass)
-		case item.containsReject():
-			results.add(item.Port, planResultReject)
-		case item.containsDrop():
-			results.add(item.Port, planResultDrop)
+		if !p.isSweepProbe(item) {
+			results.add(item.getFlow(), item.Port, item.getResult(),
+				item.getReason())
 		}
 
 		i++
 	}
-	log.Printf("Printing results:\n%s", &results)
+	return results
 }
 
-// printPacketDiffs prints packet differences to the console
-func (p *plan) printPacketDiffs() {
-	i := uint32(0)
-	for {
-		item := p.items[i]
-		if item == nil {
-			break
+// getZoneMatrix returns the number of plan results of all sender and
+// receiver pairs as a matrix with sender clients as rows and receiver
+// clients as columns
+func (p *plan) getZoneMatrix() string {
+	// get sorted senders and receivers
+	senders := []uint8{}
+	receivers := []uint8{}
+	for _, q := range p.queues {
+		if !slices.Contains(senders, q.senderID) {
+			senders = append(senders, q.senderID)
+		}
+		if !slices.Contains(receivers, q.receiverID) {
+			receivers = append(receivers, q.receiverID)
+		}
+	}
+	slices.Sort(senders)
+	slices.Sort(receivers)
+
+	// count plan results of each pair
+	cells := make(map[[2]uint8]string)
+	for _, q := range p.queues {
+		counts := make([]int, planResultUnknown+1)
+		for _, item := range q.items {
+			if !p.isSweepProbe(item) {
+				counts[item.getResult()]++
+			}
 		}
+		cell := []string{}
+		for result, count := range counts {
+			if count > 0 {
+				cell = append(cell, fmt.Sprintf("%s=%d",
+					planResultString(uint8(result)), count))
+			}
+		}
+		cells[[2]uint8{q.senderID, q.receiverID}] = strings.Join(cell,
+			" ")
+	}
+
+	// print matrix
+	b := &strings.Builder{}
+	w := tabwriter.NewWriter(b, 0, 8, 2, ' ', 0)
+	fmt.Fprint(w, "sender\\receiver")
+	for _, r := range receivers {
+		fmt.Fprintf(w, "\t%d", r)
+	}
+	fmt.Fprintln(w)
+	for _, sender := range senders {
+		fmt.Fprintf(w, "%d", sender)
+		for _, r := range receivers {
+			cell, ok := cells[[2]uint8{sender, r}]
+			if !ok {
+				cell = "-"
+			}
+			fmt.Fprintf(w, "\t%s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+	_ = w.Flush()
+	return b.String()
+}
+
+// getHopResults returns the hop results of all plan items with hops; of ttl
+// sweeps, only the last probe is included
+func (p *plan) getHopResults() *planHopResults {
+	results := &planHopResults{}
+	for _, item := range p.getResultItems() {
+		if len(item.Hops) == 0 {
+			continue
+		}
+		results.add(item.getFlow(), item.Port, item.getHopResult())
+	}
+	return results
+}
+
+// printResults prints results of this plan to the console; if the plan
+// contains multiple sender and receiver pairs, it also prints the zone
+// matrix of the pairs, if it contains hops, it also prints the hop results,
+// if it contains rejects, it also prints the sources of the rejects, if it
+// contains ttl sweeps, it also prints their paths
+func (p *plan) printResults() {
+	log.Printf("Printing results:\n%s", p.getResults())
+	if len(p.queues) > 1 {
+		log.Printf("Printing zone matrix (sender\\receiver):\n%s",
+			p.getZoneMatrix())
+	}
+	if hops := p.getHopResults(); len(hops.ranges) > 0 {
+		log.Printf("Printing hop results:\n%s", hops)
+	}
+	if sources := p.getRejectSources(); len(sources.ranges) > 0 {
+		log.Printf("Printing reject sources:\n%s", sources)
+	}
+	if sweeps := p.getTTLResults(); len(sweeps.ranges) > 0 {
+		log.Printf("Printing ttl sweep results:\n%s", sweeps)
+	}
+}
+
+// getExpectations returns the expected results of this plan together with
+// the actual results; of ttl sweeps, only the last probe is included
+func (p *plan) getExpectations() *planDiffResults {
+	expectations := &planDiffResults{}
+	for _, item := range p.getResultItems() {
+		// skip items without expected result
+		expected, ok := parsePlanResult(item.Expected)
+		if !ok {
+			continue
+		}
+
+		// add expected and actual result
+		expectations.add(item.getFlow(), item.Port, expected,
+			item.getResult())
+	}
+	return expectations
+}
+
+// getMismatches returns the expected results of this plan that do not match
+// the actual results
+func (p *plan) getMismatches() *planDiffResults {
+	mismatches := &planDiffResults{}
+	for _, r := range p.getExpectations().ranges {
+		if r.before != r.after {
+			mismatches.ranges = append(mismatches.ranges, r)
+		}
+	}
+	return mismatches
+}
+
+// checkExpectations compares the results of this plan with the expected
+// results, prints mismatches to the console and returns if all match
+func (p *plan) checkExpectations() bool {
+	mismatches := p.getMismatches()
+	if len(mismatches.ranges) == 0 {
+		return true
+	}
+	log.Printf("Printing mismatches (expected -> result):\n%s",
+		mismatches)
+	return false
+}
+
+// printPacketDiffs prints packet differences to the console; of ttl sweeps,
+// only the last probe is included
+func (p *plan) printPacketDiffs() {
+	for _, item := range p.getResultItems() {
 		item.printPacketDiffs()
-		i++
 	}
 }
 
-// writeFile writes all plan items including results to file
-func (p *plan) writeFile(file string) {
+// writeFile writes all plan items including results to file in format
+func (p *plan) writeFile(file string, format string) {
 	log.Println("Writing plan to file", file)
-	j, err := json.MarshalIndent(p.items, "", "    ")
+	writer := resultWriters[format]
+	if writer == nil {
+		log.Fatal("unknown output format: ", format)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := os.WriteFile(file, j, 0600); err != nil {
+	if err := writer.write(f, p); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readFile reads all plan items including results from file
+func (p *plan) readFile(file string) {
+	log.Println("Reading plan from file", file)
+	j, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(j, &p.items); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writePcapFile writes the probe packets and all packets in results of all
+// plan items to a pcapng file
+func (p *plan) writePcapFile(file string) {
+	log.Println("Writing packets to pcap file", file)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := newPcapngWriter(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := uint32(0); p.items[i] != nil; i++ {
+		item := p.items[i]
+		if item.SendTime.IsZero() {
+			// probe was not sent
+			continue
+		}
+		verdict := item.getResult()
+		comment := func(side, result string) string {
+			return fmt.Sprintf("item=%d side=%s verdict=%s %s",
+				item.ID, side, planResultString(verdict),
+				result)
+		}
+
+		// write probe packet sent by sender
+		probe := newSenderPacket(item.SenderMsg).bytes()
+		if err := w.writePacket(item.SenderID, item.SenderMsg.Device,
+			item.SendTime, probe, comment("sender",
+				"probe")); err != nil {
+			log.Fatal(err)
+		}
+
+		// write packets captured by sender and receiver
+		for _, r := range item.SenderResults {
+			if r.Packet == nil {
+				continue
+			}
+			if err := w.writePacket(item.SenderID,
+				item.SenderMsg.Device, r.Time, r.Packet,
+				comment("sender",
+					resultString(r.Result))); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, r := range item.ReceiverResults {
+			if r.Packet == nil {
+				continue
+			}
+			if err := w.writePacket(item.ReceiverID,
+				item.ReceiverMsg.Device, r.Time, r.Packet,
+				comment("receiver",
+					resultString(r.Result))); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for i, h := range item.Hops {
+			for _, r := range h.ReceiverResults {
+				if r.Packet == nil {
+					continue
+				}
+				if err := w.writePacket(h.ReceiverID,
+					h.ReceiverMsg.Device, r.Time, r.Packet, comment(
+						fmt.Sprintf("hop%d", i+1),
+						resultString(r.Result))); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -542,25 +1418,100 @@ func newReceiverMessage(id uint32, port uint16, config *Config) *MessageTest {
 	}
 }
 
+// newHopMessage creates a new receiver message of hop for a plan; hops
+// expect the same packet as the receiver
+func newHopMessage(id uint32, port uint16, config *Config,
+	hop *Hop) *MessageTest {
+	msg := newReceiverMessage(id, port, config)
+	msg.Device = hop.Device
+	return msg
+}
+
 // newPlan creates a new plan
 func newPlan(config *Config) *plan {
+	// read plan items from plan file
+	if config.PlanFile != "" {
+		p := &plan{}
+		p.readFile(config.PlanFile)
+		p.setClients(config.SenderID, config.ReceiverID)
+		p.schedule()
+		return p
+	}
+
 	// initialize plan
 	items := make(map[uint32]*planItem)
 
 	// fill plan with plan items
 	id := uint32(0)
 	first, last := config.GetPortRange()
-	for i := first; i <= last && i != 0; i++ {
-		senderMsg := newSenderMessage(id, i, config)
-		receiverMsg := newReceiverMessage(id, i, config)
-		item := newPlanItem(id, i, senderMsg, receiverMsg)
-		items[id] = item
-		id++
+	expectations := config.GetExpectations()
+	hops := config.GetHops()
+	ttls := []uint8{0}
+	switch config.Mode {
+	case ModeTTL:
+		ttls = []uint8{}
+		for ttl := uint8(1); ttl <= config.MaxTTL && ttl != 0; ttl++ {
+			ttls = append(ttls, ttl)
+		}
+	case ModeFirewalk:
+		// probes expire one hop behind the middlebox, so they do not
+		// need a receiver
+		ttls = []uint8{config.GatewayHops + 1}
+		hops = nil
+	}
+	malforms := config.GetMalforms()
+	if len(malforms) == 0 {
+		malforms = []string{""}
 	}
+	for _, malform := range malforms {
+		for i := first; i <= last && i != 0; i++ {
+			for _, ttl := range ttls {
+				senderMsg := newSenderMessage(id, i, config)
+				senderMsg.TTL = ttl
+				senderMsg.Malform = malform
+				if !malformApplies(malform, senderMsg) {
+					continue
+				}
+				receiverMsg := newReceiverMessage(id, i, config)
+				receiverMsg.setMalform(senderMsg)
+				if config.Mode == ModeFirewalk {
+					receiverMsg = nil
+				}
+				item := newPlanItem(id, i, senderMsg, receiverMsg)
+				for _, h := range hops {
+					hopMsg := newHopMessage(id, i, config, h)
+					hopMsg.setMalform(senderMsg)
+					item.Hops = append(item.Hops, &planHop{
+						ReceiverID:  h.ClientID,
+						ReceiverMsg: hopMsg,
+					})
+				}
 
-	return &plan{
-		senderID:   config.SenderID,
-		receiverID: config.ReceiverID,
-		items:      items,
+				// only the last probe of a ttl sweep is expected
+				// to reach the receiver
+				for _, e := range expectations {
+					if ttl == ttls[len(ttls)-1] &&
+						i >= e.FirstPort && i <= e.LastPort {
+						item.Expected = e.Result
+						break
+					}
+				}
+				items[id] = item
+				id++
+			}
+		}
 	}
+
+	p := &plan{items: items}
+	p.setClients(config.SenderID, config.ReceiverID)
+	p.schedule()
+	return p
+}
+
+// newPlanFromFile creates a new plan from the plan items in file
+func newPlanFromFile(file string) *plan {
+	p := &plan{}
+	p.readFile(file)
+	p.schedule()
+	return p
 }
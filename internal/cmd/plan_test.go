@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"testing"
 )
@@ -87,7 +89,7 @@ func Example_printResults_dropTCPReset() {
 	// Output:
 	// Printing results:
 	// 1024:1026	drop
-	// 1027:1029	reject
+	// 1027:1029	reject: tcp-reset
 	// 1030:1032	drop
 }
 
@@ -113,7 +115,39 @@ func Example_printResults_rejectTCPReset() {
 
 	// Output:
 	// Printing results:
-	// 1024:1032	reject
+	// 1024:1032	reject: tcp-reset
+}
+
+// Example_printResults_verdicts runs printResults() with reject reasons,
+// errors and mixed results
+func Example_printResults_verdicts() {
+	// init
+	plan := getExamplePrintResultsPlan("1024:1030")
+
+	// set results of items
+	reject := func(result uint8) []*MessageResult {
+		return []*MessageResult{{Result: result}}
+	}
+	plan.items[0].SenderResults = reject(ResultICMPv4CommProhibited)
+	plan.items[1].SenderResults = reject(ResultTCPReset)
+	plan.items[2].SenderResults = reject(ResultTCPReset)
+	plan.items[2].ReceiverResults = []*MessageResult{{Result: ResultPass}}
+	plan.items[3].ReceiverResults = []*MessageResult{{Result: ResultError}}
+	plan.items[4].SenderResults = []*MessageResult{{Result: ResultTimeout}}
+	plan.items[5].ReceiverResults = []*MessageResult{{Result: ResultNone}}
+
+	// check output
+	plan.printResults()
+
+	// Output:
+	// Printing results:
+	// 1024	reject: icmpv4-comm-prohibited
+	// 1025	reject: tcp-reset
+	// 1026	pass+reject: tcp-reset
+	// 1027	error: error
+	// 1028	error: timeout
+	// 1029	unknown
+	// 1030	drop
 }
 
 // Example_printResults_pass runs printResults() with passing packets
@@ -174,7 +208,7 @@ func Example_printResults_even() {
 	// Output:
 	// Printing results:
 	// 1024:1026	drop
-	// 1027:1029	reject
+	// 1027:1029	reject: tcp-reset
 	// 1030:1032	pass
 }
 
@@ -213,13 +247,13 @@ func Example_printResults_interleaved() {
 	// Output:
 	// Printing results:
 	// 1024	drop
-	// 1025	reject
+	// 1025	reject: tcp-reset
 	// 1026	pass
 	// 1027	drop
-	// 1028	reject
+	// 1028	reject: tcp-reset
 	// 1029	pass
 	// 1030	drop
-	// 1031	reject
+	// 1031	reject: tcp-reset
 	// 1032	pass
 }
 
@@ -257,3 +291,320 @@ func TestNewPlan(t *testing.T) {
 	test("100000", 0)
 	test("65534:65555", 0)
 }
+
+// Example_checkExpectations_match runs checkExpectations() with results
+// matching the expected results
+func Example_checkExpectations_match() {
+	// init
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	config.Expect = "1027:1029=pass,*=drop"
+	plan := newPlan(config)
+
+	// set pass results for some items
+	presults := []*MessageResult{{Result: ResultPass}}
+	for i := uint32(3); i < 6; i++ {
+		plan.items[i].ReceiverResults = presults
+	}
+
+	// check output
+	fmt.Println(plan.checkExpectations())
+
+	// Output:
+	// true
+}
+
+// Example_checkExpectations_mismatch runs checkExpectations() with results
+// not matching the expected results
+func Example_checkExpectations_mismatch() {
+	// init
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	config.SenderSrcIP = "192.168.1.1"
+	config.SenderDstIP = "192.168.1.2"
+	config.Expect = "1024=pass,1025=reject,*=drop"
+	plan := newPlan(config)
+
+	// set results for some items
+	presults := []*MessageResult{{Result: ResultPass}}
+	rresults := []*MessageResult{{Result: ResultTCPReset}}
+	plan.items[0].ReceiverResults = presults
+	plan.items[7].SenderResults = rresults
+	plan.items[8].ReceiverResults = presults
+
+	// check output
+	fmt.Println(plan.checkExpectations())
+
+	// Output:
+	// Printing mismatches (expected -> result):
+	// tcp 192.168.1.1 -> 192.168.1.2
+	// 1025	reject -> drop
+	// 1031	drop -> reject
+	// 1032	drop -> pass
+	// false
+}
+
+// TestCheckClient tests checking client capabilities against a plan
+func TestCheckClient(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	config.SenderDevice = "veth2"
+	config.ReceiverDevice = "veth4"
+	p := newPlan(config)
+
+	test := func(clientID uint8, reg *MessageRegister, want bool) {
+		err := p.checkClient(clientID, reg)
+		if got := err == nil; got != want {
+			t.Errorf("got %v, want %t", err, want)
+		}
+	}
+	newReg := func(device string) *MessageRegister {
+		return &MessageRegister{
+			Version:    ProtocolVersion,
+			Protocols:  []uint16{ProtocolTCP, ProtocolUDP},
+			Features:   ClientFeatures,
+			Interfaces: []*MessageInterface{{Name: device}},
+		}
+	}
+
+	// test valid clients
+	test(1, newReg("veth2"), true)
+	test(2, newReg("veth4"), true)
+
+	// test invalid devices and client ids
+	test(1, newReg("veth4"), false)
+	test(2, newReg("veth2"), false)
+	test(3, newReg("veth2"), false)
+
+	// test missing protocol and feature
+	reg := newReg("veth2")
+	reg.Protocols = []uint16{ProtocolUDP}
+	test(1, reg, false)
+	reg = newReg("veth2")
+	reg.Features = []string{FeatureReceiver}
+	test(1, reg, false)
+}
+
+// TestHandleClientLost tests marking plan items of lost clients as errored
+func TestHandleClientLost(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	p := newPlan(config)
+	p.handleClient(1)
+	p.handleClient(2)
+
+	p.handleClientLost(2)
+	if p.clientsActive() {
+		t.Errorf("got active clients, want inactive receiver")
+	}
+	q := p.getQueues(2)[0]
+	item := q.getCurrentItem()
+	if len(item.ReceiverResults) != 1 ||
+		item.ReceiverResults[0].Result != ResultError {
+		t.Errorf("got %v, want error result", item.ReceiverResults)
+	}
+
+	p.handleClient(2)
+	if item := q.restartCurrentItem(); len(item.ReceiverResults) != 0 {
+		t.Errorf("got %v, want no results", item.ReceiverResults)
+	}
+}
+
+// newPairsPlan creates a plan with items of the sender and receiver pairs
+// 1 -> 2, 1 -> 3 and 2 -> 3
+func newPairsPlan() *plan {
+	pairs := [][2]uint8{{1, 2}, {1, 3}, {2, 3}}
+	items := make(map[uint32]*planItem)
+	for i := uint32(0); i < 6; i++ {
+		pair := pairs[i%3]
+		items[i] = newPlanItem(i, uint16(1024+i/3),
+			&MessageTest{ID: i, Initiate: true}, &MessageTest{ID: i})
+		items[i].SenderID = pair[0]
+		items[i].ReceiverID = pair[1]
+	}
+	p := &plan{items: items}
+	p.schedule()
+	return p
+}
+
+// TestPlanQueues tests scheduling plan items of multiple sender and receiver
+// pairs
+func TestPlanQueues(t *testing.T) {
+	p := newPairsPlan()
+	if len(p.queues) != 3 {
+		t.Fatalf("got %d queues, want 3", len(p.queues))
+	}
+	if !p.isSender(2) || !p.isReceiver(2) || p.isSender(3) {
+		t.Errorf("invalid senders and receivers")
+	}
+	if n := len(p.getQueues(1)); n != 2 {
+		t.Errorf("got %d queues of client 1, want 2", n)
+	}
+
+	// queues are independent
+	p.handleClient(1)
+	p.handleClient(2)
+	if !p.queueActive(p.queues[0]) || p.queueActive(p.queues[1]) ||
+		p.clientsActive() {
+		t.Errorf("invalid active queues")
+	}
+	q := p.queues[0]
+	if item := q.getNextItem(); item.ID != 3 {
+		t.Errorf("got item %d, want 3", item.ID)
+	}
+	if q.getNextItem() != nil || p.isDone() {
+		t.Errorf("invalid end of queue")
+	}
+
+	// results are only accepted from the item's clients
+	p.handleResult(3, &MessageResult{ID: 0, Result: ResultPass})
+	p.handleResult(2, &MessageResult{ID: 0, Result: ResultPass})
+	if n := len(p.items[0].ReceiverResults); n != 1 {
+		t.Errorf("got %d results, want 1", n)
+	}
+}
+
+func Example_getZoneMatrix() {
+	p := newPairsPlan()
+	p.items[0].ReceiverResults = []*MessageResult{{Result: ResultPass}}
+	p.items[3].ReceiverResults = []*MessageResult{{Result: ResultPass}}
+	p.items[1].SenderResults = []*MessageResult{{Result: ResultTCPReset}}
+	p.items[5].ReceiverResults = []*MessageResult{{Result: ResultError}}
+	fmt.Print(p.getZoneMatrix())
+	// Output:
+	// sender\receiver  2       3
+	// 1                pass=2  reject=1 drop=1
+	// 2                -       drop=1 error=1
+}
+
+// TestHandleResultRoles tests a client that is sender and receiver
+func TestHandleResultRoles(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	config.SenderID = 1
+	config.ReceiverID = 1
+	config.SenderDevice = "veth2"
+	config.ReceiverDevice = "veth4"
+	p := newPlan(config)
+
+	// client needs both devices
+	reg := &MessageRegister{
+		Version:    ProtocolVersion,
+		Protocols:  []uint16{ProtocolTCP, ProtocolUDP},
+		Features:   ClientFeatures,
+		Interfaces: []*MessageInterface{{Name: "veth2"}},
+	}
+	if err := p.checkClient(1, reg); err == nil {
+		t.Errorf("got nil, want missing device")
+	}
+	reg.Interfaces = append(reg.Interfaces, &MessageInterface{Name: "veth4"})
+	if err := p.checkClient(1, reg); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+
+	// results are assigned by role
+	p.handleClient(1)
+	if !p.clientsActive() {
+		t.Errorf("got inactive clients, want active")
+	}
+	p.handleResult(1, &MessageResult{Result: ResultReady, Role: RoleReceiver})
+	p.handleResult(1, &MessageResult{Result: ResultPass, Role: RoleReceiver})
+	p.handleResult(1, &MessageResult{Result: ResultTCPReset, Role: RoleSender})
+	item := p.items[0]
+	if !item.receiverReady || len(item.ReceiverResults) != 1 ||
+		len(item.SenderResults) != 1 ||
+		item.SenderResults[0].Result != ResultTCPReset {
+		t.Errorf("got invalid results %v, %v", item.SenderResults,
+			item.ReceiverResults)
+	}
+}
+
+// TestGetResultPathError tests results of plan items with icmp errors of the
+// path that are not rejects
+func TestGetResultPathError(t *testing.T) {
+	for _, test := range []struct {
+		results []uint8
+		result  uint8
+		reason  string
+	}{
+		{[]uint8{ResultICMPv6PacketTooBig}, planResultUnknown,
+			"icmpv6-packet-too-big"},
+		{[]uint8{ResultICMPv4TTLExceeded}, planResultUnknown,
+			resultString(ResultICMPv4TTLExceeded)},
+		{[]uint8{ResultICMPv6ParameterProblem}, planResultUnknown,
+			resultString(ResultICMPv6ParameterProblem)},
+		{[]uint8{ResultICMPv6PacketTooBig, ResultTCPReset},
+			planResultReject, "tcp-reset"},
+	} {
+		item := &planItem{SenderMsg: &MessageTest{}}
+		for _, r := range test.results {
+			item.SenderResults = append(item.SenderResults,
+				&MessageResult{Result: r})
+		}
+		if got := item.getResult(); got != test.result {
+			t.Errorf("got %s, want %s", planResultString(got),
+				planResultString(test.result))
+		}
+		if got := item.getReason(); got != test.reason {
+			t.Errorf("got %s, want %s", got, test.reason)
+		}
+	}
+}
+
+func Example_getHopResults() {
+	config := NewConfig()
+	config.PortRange = "1024:1027"
+	config.SenderSrcMAC = "0a:bc:de:f0:00:12"
+	config.SenderDstMAC = "0a:bc:de:f0:00:22"
+	config.SenderSrcIP = "192.168.1.1"
+	config.SenderDstIP = "192.168.2.1"
+	config.ReceiverSrcIP = "192.168.1.1"
+	config.ReceiverDstIP = "192.168.2.1"
+	config.ReceiverDevice = "veth4"
+	config.Hops = "3:veth6,4:veth8"
+	p := newPlan(config)
+
+	// create passing results of receiver or hop for item; if rewrite is
+	// set, the packet has a rewritten source ip address
+	pass := func(clientID uint8, id uint32, rewrite bool) {
+		test := *p.items[id].SenderMsg
+		if rewrite {
+			test.SrcIP = net.ParseIP("10.0.0.1")
+		}
+		p.handleResult(clientID, &MessageResult{
+			ID:     id,
+			Result: ResultPass,
+			Packet: newSenderPacket(&test).bytes(),
+			Role:   RoleReceiver,
+		})
+	}
+
+	// port 1024 passes all hops
+	pass(3, 0, false)
+	pass(4, 0, false)
+	pass(2, 0, false)
+
+	// port 1025 is dropped after the first hop
+	pass(3, 1, false)
+
+	// port 1026 is rewritten after the first hop
+	pass(3, 2, false)
+	pass(4, 2, true)
+	pass(2, 2, true)
+
+	// port 1027 is rejected before the first hop
+	p.handleResult(1, &MessageResult{ID: 3, Result: ResultTCPReset,
+		Role: RoleSender})
+
+	fmt.Print(p.getHopResults())
+	// Output:
+	// tcp 192.168.1.1 -> 192.168.2.1
+	// 1024	passed all hops
+	// 1025	dropped before hop 2 (client 4, veth8)
+	// 1026	rewritten before hop 2 (client 4, veth8)
+	// 1027	rejected before hop 1 (client 3, veth6)
+}
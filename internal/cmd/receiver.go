@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"net"
 	"time"
 
@@ -85,8 +86,8 @@ func (r *receiver) handleIP(packet gopacket.Packet) bool {
 		return true
 	}
 
-	// check ipv4 or ipv6 addresses
-	if r.test.SrcIP.To4() != nil {
+	// check ipv4 or ipv6 addresses, src ip is not set for spoofed packets
+	if r.test.SrcIP.To4() != nil || r.test.DstIP.To4() != nil {
 		return r.handleIPv4(packet)
 	}
 	return r.handleIPv6(packet)
@@ -140,6 +141,34 @@ func (r *receiver) handleUDP(packet gopacket.Packet) bool {
 	return r.checkPorts(uint16(udp.SrcPort), uint16(udp.DstPort))
 }
 
+// handleMalformedL4 checks if L4 values in malformed packet match the
+// current test; it only checks the ports at the start of the raw l4 header
+// because lengths and checksums of the packet may be invalid
+func (r *receiver) handleMalformedL4(packet gopacket.Packet) bool {
+	// get raw l4 header after the ip header
+	var protocol layers.IPProtocol
+	var l4 []byte
+	switch {
+	case packet.Layer(layers.LayerTypeIPv4) != nil:
+		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		protocol = ip.Protocol
+		l4 = ip.LayerPayload()
+	case packet.Layer(layers.LayerTypeIPv6) != nil:
+		ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		protocol = ip.NextHeader
+		l4 = ip.LayerPayload()
+	default:
+		return false
+	}
+
+	// check protocol and ports
+	if uint16(protocol) != r.test.Protocol || len(l4) < 4 {
+		return false
+	}
+	return r.checkPorts(binary.BigEndian.Uint16(l4[0:2]),
+		binary.BigEndian.Uint16(l4[2:4]))
+}
+
 // handleL4 checks if L4 values in packet match the current test
 func (r *receiver) handleL4(packet gopacket.Packet) bool {
 	// if we do not care about l4, skip the following checks
@@ -147,6 +176,11 @@ func (r *receiver) handleL4(packet gopacket.Packet) bool {
 		return true
 	}
 
+	// check malformed packets
+	if r.test.Malform != "" {
+		return r.handleMalformedL4(packet)
+	}
+
 	// check tcp
 	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 		if r.test.Protocol != ProtocolTCP {
@@ -186,8 +220,11 @@ func (r *receiver) HandlePacket(packet gopacket.Packet) {
 	// send result back to server
 	r.results <- &MessageResult{
 		ID:     r.test.ID,
+		Run:    r.test.Run,
+		Role:   RoleReceiver,
 		Result: ResultPass,
 		Packet: packet.Data(),
+		Time:   packet.Metadata().Timestamp,
 	}
 }
 
@@ -198,6 +235,8 @@ func (r *receiver) run() {
 	packetListeners.get(r.test.Device).register(r)
 	r.results <- &MessageResult{
 		ID:     r.test.ID,
+		Run:    r.test.Run,
+		Role:   RoleReceiver,
 		Result: ResultReady,
 	}
 
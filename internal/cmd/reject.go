@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// rejectInitialTTLs are the common initial ttl and hop limit values used to
+// estimate the number of hops between a reject source and the sender
+var rejectInitialTTLs = []uint8{32, 64, 128, 255}
+
+// rejectHops estimates the number of hops a packet with ttl travelled
+func rejectHops(ttl uint8) uint8 {
+	for _, initial := range rejectInitialTTLs {
+		if ttl <= initial {
+			return initial - ttl
+		}
+	}
+	return 0
+}
+
+// rejectSource is the device that generated an icmp error or a tcp reset
+type rejectSource struct {
+	result    uint8
+	ip        net.IP
+	mac       net.HardwareAddr
+	ttl       uint8
+	target    bool
+	quoted    bool
+	quotedTTL uint8
+	rewrites  planPacketDiffs
+}
+
+// String converts the reject source to a string, e.g., "tcp-reset from
+// target 10.0.0.2 (mac 02:00:00:00:00:02, ttl 64, distance 0)"
+func (r *rejectSource) String() string {
+	device := "middlebox"
+	if r.target {
+		device = "target"
+	}
+	s := fmt.Sprintf("%s from %s %s (mac %s, ttl %d, distance %d)",
+		resultString(r.result), device, r.ip, r.mac, r.ttl,
+		rejectHops(r.ttl))
+	if r.quoted {
+		s += fmt.Sprintf(", quoted ttl %d", r.quotedTTL)
+	}
+	for _, d := range r.rewrites {
+		s += fmt.Sprintf(", rewritten %s", d)
+	}
+	return s
+}
+
+// getQuotedL4Diffs gets differences between the sent packet and the quoted
+// layer 4 header in payload of quoted packet with protocol
+func (p *planItem) getQuotedL4Diffs(diffs *planPacketDiffs,
+	protocol layers.IPProtocol, payload []byte) {
+	// icmp errors contain at least the first 8 bytes of the l4 header
+	if len(payload) < 8 {
+		return
+	}
+	p.getPortDiffs(diffs, binary.BigEndian.Uint16(payload[0:2]),
+		binary.BigEndian.Uint16(payload[2:4]))
+
+	// tcp sequence number contains the test id
+	if protocol == layers.IPProtocolTCP {
+		if seq := binary.BigEndian.Uint32(payload[4:8]); seq != p.ID {
+			diffs.add(
+				"Seq",
+				fmt.Sprintf("%d", p.ID),
+				fmt.Sprintf("%d", seq),
+			)
+		}
+	}
+}
+
+// getQuotedIPv4 analyzes the packet quoted in icmpv4 error message icmp and
+// adds it to source
+func (p *planItem) getQuotedIPv4(source *rejectSource, icmp *layers.ICMPv4) {
+	ip := &layers.IPv4{}
+	if err := ip.DecodeFromBytes(icmp.Payload,
+		gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	source.quoted = true
+	source.quotedTTL = ip.TTL
+	p.getIPAddrDiffs(&source.rewrites, ip.SrcIP, ip.DstIP)
+	if ip.TOS != 0 {
+		source.rewrites.add("TOS", "0", fmt.Sprintf("%d", ip.TOS))
+	}
+	p.getQuotedL4Diffs(&source.rewrites, ip.Protocol, ip.Payload)
+}
+
+// getQuotedIPv6 analyzes the packet quoted in icmpv6 error message icmp and
+// adds it to source
+func (p *planItem) getQuotedIPv6(source *rejectSource, icmp *layers.ICMPv6) {
+	// skip first 4 bytes (unused)
+	if len(icmp.Payload) < 4 {
+		return
+	}
+	ip := &layers.IPv6{}
+	if err := ip.DecodeFromBytes(icmp.Payload[4:],
+		gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	source.quoted = true
+	source.quotedTTL = ip.HopLimit
+	p.getIPAddrDiffs(&source.rewrites, ip.SrcIP, ip.DstIP)
+	if ip.TrafficClass != 0 {
+		source.rewrites.add("TrafficClass", "0",
+			fmt.Sprintf("%d", ip.TrafficClass))
+	}
+	p.getQuotedL4Diffs(&source.rewrites, ip.NextHeader, ip.Payload)
+}
+
+// getRejectSource returns the source of the reject result r of the plan
+// item; returns nil if r does not contain a valid packet
+func (p *planItem) getRejectSource(r *MessageResult) *rejectSource {
+	if r.Packet == nil {
+		return nil
+	}
+	packet := gopacket.NewPacket(r.Packet, layers.LayerTypeEthernet,
+		gopacket.Default)
+	source := &rejectSource{result: r.Result}
+
+	// get ethernet header
+	if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
+		eth, _ := ethLayer.(*layers.Ethernet)
+		source.mac = eth.SrcMAC
+	}
+
+	// get ip header
+	switch {
+	case packet.Layer(layers.LayerTypeIPv4) != nil:
+		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		source.ip = ip.SrcIP
+		source.ttl = ip.TTL
+	case packet.Layer(layers.LayerTypeIPv6) != nil:
+		ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		source.ip = ip.SrcIP
+		source.ttl = ip.HopLimit
+	default:
+		return nil
+	}
+	source.target = source.ip.Equal(p.SenderMsg.DstIP)
+
+	// get quoted packet of icmp error messages
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv4)
+		p.getQuotedIPv4(source, icmp)
+	}
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv6)
+		p.getQuotedIPv6(source, icmp)
+	}
+	return source
+}
+
+// getRejectSources returns the sources of all reject results of the plan
+// item as string
+func (p *planItem) getRejectSources() string {
+	sources := []string{}
+	for _, r := range p.SenderResults {
+		if !isReject(r.Result) {
+			continue
+		}
+		source := p.getRejectSource(r)
+		if source == nil {
+			continue
+		}
+		s := source.String()
+		if !slices.Contains(sources, s) {
+			sources = append(sources, s)
+		}
+	}
+	return strings.Join(sources, "; ")
+}
+
+// getRejectSources returns the reject sources of all rejected plan items; of
+// ttl sweeps, only the last probe is included
+func (p *plan) getRejectSources() *planHopResults {
+	results := &planHopResults{}
+	for i := uint32(0); p.items[i] != nil; i++ {
+		item := p.items[i]
+		if !item.containsReject() || p.isSweepProbe(item) {
+			continue
+		}
+		if sources := item.getRejectSources(); sources != "" {
+			results.add(item.getFlow(), item.Port, sources)
+		}
+	}
+	return results
+}
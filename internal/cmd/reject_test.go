@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// getExampleRejectPacket serializes the layers of a reject packet for the
+// reject source examples
+func getExampleRejectPacket(l ...gopacket.SerializableLayer) []byte {
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Example_printResults_rejectSources runs printResults() with rejects
+// generated by a middlebox and by the target host
+func Example_printResults_rejectSources() {
+	// init
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.PortRange = "1024:1027"
+	config.Protocol = ProtocolUDP
+	config.SenderSrcMAC = "02:00:00:00:00:02"
+	config.SenderDstMAC = "02:00:00:00:00:01"
+	config.SenderSrcIP = "10.0.1.1"
+	config.SenderDstIP = "10.0.2.2"
+	plan := newPlan(config)
+	eth := &layers.Ethernet{
+		SrcMAC:       []byte{2, 0, 0, 0, 0, 1},
+		DstMAC:       []byte{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	// icmp error from middlebox quoting the probe with remarked tos
+	for i := uint32(0); i < 2; i++ {
+		item := plan.items[i]
+		probe := newSenderPacket(item.SenderMsg).bytes()[14:]
+		probe[1] = 0x10
+		probe[8] = 63
+		item.SenderResults = []*MessageResult{{
+			Result: ResultICMPv4CommProhibited,
+			Packet: getExampleRejectPacket(
+				eth,
+				&layers.IPv4{
+					Version:  4,
+					TTL:      63,
+					Protocol: layers.IPProtocolICMPv4,
+					SrcIP:    []byte{10, 0, 1, 254},
+					DstIP:    []byte{10, 0, 1, 1},
+				},
+				&layers.ICMPv4{
+					TypeCode: layers.CreateICMPv4TypeCode(
+						layers.ICMPv4TypeDestinationUnreachable,
+						layers.ICMPv4CodeCommAdminProhibited),
+				},
+				gopacket.Payload(probe),
+			),
+		}}
+	}
+
+	// icmp error from target
+	item := plan.items[2]
+	item.SenderResults = []*MessageResult{{
+		Result: ResultICMPv4PortUnreachable,
+		Packet: getExampleRejectPacket(
+			eth,
+			&layers.IPv4{
+				Version:  4,
+				TTL:      62,
+				Protocol: layers.IPProtocolICMPv4,
+				SrcIP:    []byte{10, 0, 2, 2},
+				DstIP:    []byte{10, 0, 1, 1},
+			},
+			&layers.ICMPv4{
+				TypeCode: layers.CreateICMPv4TypeCode(
+					layers.ICMPv4TypeDestinationUnreachable,
+					layers.ICMPv4CodePort),
+			},
+			gopacket.Payload(newSenderPacket(item.SenderMsg).bytes()[14:]),
+		),
+	}}
+
+	// check output
+	plan.printResults()
+
+	// Output:
+	// Printing results:
+	// 1024:1025	reject: icmpv4-comm-prohibited
+	// 1026	reject: icmpv4-port-unreachable
+	// 1027	drop
+	// Printing reject sources:
+	// udp 10.0.1.1 -> 10.0.2.2
+	// 1024:1025	icmpv4-comm-prohibited from middlebox 10.0.1.254 (mac 02:00:00:00:00:01, ttl 63, distance 1), quoted ttl 63, rewritten TOS: 0 -> 16
+	// 1026	icmpv4-port-unreachable from target 10.0.2.2 (mac 02:00:00:00:00:01, ttl 62, distance 2), quoted ttl 64
+}
@@ -3,12 +3,19 @@ package cmd
 import (
 	"encoding/binary"
 	"log"
+	"net"
 	"time"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 )
 
+// icmpv6 destination unreachable codes not defined in layers
+const (
+	icmpv6CodeSrcRoutingHeader = 7
+	icmpv6CodeHeadersTooLong   = 8
+)
+
 // senderPacket is a test packet sent by the sender
 type senderPacket struct {
 	test   *MessageTest
@@ -37,15 +44,26 @@ func (s *senderPacket) createPacketEthernet() {
 	s.layers = append(s.layers, &eth)
 }
 
+// getTTL returns the ttl or hop limit of the packet
+func (s *senderPacket) getTTL() uint8 {
+	if s.test.TTL == 0 {
+		return 64
+	}
+	return s.test.TTL
+}
+
 // createPacketIPv4 creates the ipv4 header of the packet
 func (s *senderPacket) createPacketIPv4() {
 	ip := layers.IPv4{
 		Version: 4,
 		Flags:   layers.IPv4DontFragment,
-		TTL:     64,
-		SrcIP:   s.test.SrcIP,
+		TTL:     s.getTTL(),
+		SrcIP:   getMalformSrcIP(s.test),
 		DstIP:   s.test.DstIP,
 	}
+	if s.test.Malform == MalformReservedFlags {
+		ip.Flags |= layers.IPv4EvilBit
+	}
 
 	switch s.test.Protocol {
 	case ProtocolUDP:
@@ -61,8 +79,8 @@ func (s *senderPacket) createPacketIPv4() {
 func (s *senderPacket) createPacketIPv6() {
 	ip := layers.IPv6{
 		Version:  6,
-		HopLimit: 64,
-		SrcIP:    s.test.SrcIP,
+		HopLimit: s.getTTL(),
+		SrcIP:    getMalformSrcIP(s.test),
 		DstIP:    s.test.DstIP,
 	}
 
@@ -88,12 +106,16 @@ func (s *senderPacket) createPacketIP() {
 // createPacketTCP creates the tcp header of the packet
 func (s *senderPacket) createPacketTCP() {
 	tcp := layers.TCP{
-		SrcPort: layers.TCPPort(s.test.SrcPort),
+		SrcPort: layers.TCPPort(getMalformSrcPort(s.test)),
 		DstPort: layers.TCPPort(s.test.DstPort),
 		Seq:     s.test.ID,
 		SYN:     true,
 		Window:  64000,
 	}
+	if s.test.Malform == MalformReservedFlags {
+		// the former ecn nonce flag is reserved again (rfc 8311)
+		tcp.NS = true
+	}
 	layer3 := s.layers[1].(gopacket.NetworkLayer)
 	if err := tcp.SetNetworkLayerForChecksum(layer3); err != nil {
 		log.Fatal(err)
@@ -105,7 +127,7 @@ func (s *senderPacket) createPacketTCP() {
 // createPacketUDP creates the udp header of the packet
 func (s *senderPacket) createPacketUDP() {
 	udp := layers.UDP{
-		SrcPort: layers.UDPPort(s.test.SrcPort),
+		SrcPort: layers.UDPPort(getMalformSrcPort(s.test)),
 		DstPort: layers.UDPPort(s.test.DstPort),
 	}
 	layer3 := s.layers[1].(gopacket.NetworkLayer)
@@ -150,14 +172,34 @@ func (s *senderPacket) createPacket() {
 	s.createPacketPayload()
 
 	// serialize packet to bytes
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	s.serializePacket(nil, gopacket.SerializeOptions{})
+
+	// malform packet and serialize it again without fixing the lengths
+	// or computing the checksum of the malformed layer
+	if malformed, opts := s.malformPacket(); malformed != nil {
+		s.serializePacket(malformed, opts)
 	}
+}
+
+// serializePacket serializes the packet layers to bytes; all layers except
+// malformed are serialized with fixed lengths and computed checksums,
+// malformed is serialized with opts
+func (s *senderPacket) serializePacket(
+	malformed gopacket.SerializableLayer, opts gopacket.SerializeOptions) {
 	buf := gopacket.NewSerializeBuffer()
-	err := gopacket.SerializeLayers(buf, opts, s.layers...)
-	if err != nil {
-		log.Fatal(err)
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		layer := s.layers[i]
+		layerOpts := gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		}
+		if layer == malformed {
+			layerOpts = opts
+		}
+		if err := layer.SerializeTo(buf, layerOpts); err != nil {
+			log.Fatal(err)
+		}
+		buf.PushLayer(layer.LayerType())
 	}
 	s.b = buf.Bytes()
 }
@@ -191,10 +233,7 @@ func (s *sender) handleIPv4(packet gopacket.Packet) bool {
 	ipv4, _ := ipv4Layer.(*layers.IPv4)
 
 	// check destination ip
-	if !ipv4.DstIP.Equal(s.test.SrcIP) {
-		return false
-	}
-	return true
+	return s.isSourceIP(ipv4.DstIP)
 }
 
 // handleIPv6 checks if ip addresses match
@@ -207,10 +246,13 @@ func (s *sender) handleIPv6(packet gopacket.Packet) bool {
 	ipv6, _ := ipv6Layer.(*layers.IPv6)
 
 	// check destination ip
-	if !ipv6.DstIP.Equal(s.test.SrcIP) {
-		return false
-	}
-	return true
+	return s.isSourceIP(ipv6.DstIP)
+}
+
+// isSourceIP checks if ip is the source address of the test packet; errors
+// for packets with spoofed source addresses are sent to the spoofed address
+func (s *sender) isSourceIP(ip net.IP) bool {
+	return ip.Equal(s.test.SrcIP) || ip.Equal(getMalformSrcIP(s.test))
 }
 
 // handleIP checks if ip addresses match
@@ -221,164 +263,261 @@ func (s *sender) handleIP(packet gopacket.Packet) bool {
 	return s.handleIPv6(packet)
 }
 
-// handleICMPv4 handles ICMPv4 destination unreachable messages
-func (s *sender) handleICMPv4(packet gopacket.Packet) {
-	// handle icmp messages only
-	icmpv4Layer := packet.Layer(layers.LayerTypeICMPv4)
-	if icmpv4Layer == nil {
-		return
+// handleQuoted checks if the packet quoted in an icmp error message with ip
+// addresses src and dst, protocol and layer 4 header in payload matches the
+// test packet; the quoted packet is matched by the test id, so packets with
+// addresses and ports rewritten by a middlebox still match. Quoted packets
+// without test id are matched by their addresses and ports
+func (s *sender) handleQuoted(src, dst net.IP, protocol layers.IPProtocol,
+	payload []byte) bool {
+	// check protocol
+	if uint16(protocol) != s.test.Protocol {
+		return false
 	}
-	icmpv4, _ := icmpv4Layer.(*layers.ICMPv4)
 
-	// handle destination unreachable messages only
-	if icmpv4.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable {
-		return
+	// icmp error messages contain at least the first 8 bytes of the
+	// layer 4 header, ports are in the first 4 bytes of tcp and udp
+	// headers
+	if len(payload) < 8 {
+		return false
 	}
 
-	// get encapsulated packet headers
-	encap := gopacket.NewPacket(icmpv4.Payload, layers.LayerTypeIPv4,
-		gopacket.Default)
-
-	// get encapsulated ip header
-	ipv4Layer := encap.Layer(layers.LayerTypeIPv4)
-	if ipv4Layer == nil {
-		return
+	// check tcp sequence number, it contains the test id; if it was
+	// rewritten, check addresses and ports
+	if protocol == layers.IPProtocolTCP &&
+		binary.BigEndian.Uint32(payload[4:8]) == s.test.ID {
+		return true
 	}
-	ipv4, _ := ipv4Layer.(*layers.IPv4)
 
-	// check ip addresses
-	if !ipv4.SrcIP.Equal(s.test.SrcIP) || !ipv4.DstIP.Equal(s.test.DstIP) {
-		return
+	// check udp payload if it is quoted, it contains the test id
+	if protocol == layers.IPProtocolUDP && len(payload) >= 12 {
+		return binary.BigEndian.Uint32(payload[8:12]) == s.test.ID
 	}
 
-	// get encapsulated udp header
-	udpLayer := encap.Layer(layers.LayerTypeUDP)
-	if udpLayer == nil {
-		return
+	// check ip addresses and ports as sent, i.e., with malformed source
+	return src.Equal(getMalformSrcIP(s.test)) && dst.Equal(s.test.DstIP) &&
+		binary.BigEndian.Uint16(payload[0:2]) ==
+			getMalformSrcPort(s.test) &&
+		binary.BigEndian.Uint16(payload[2:4]) == s.test.DstPort
+}
+
+// handleQuotedIPv4 checks if the ipv4 packet quoted in an icmp error message
+// matches the test packet
+func (s *sender) handleQuotedIPv4(quoted []byte) bool {
+	ipv4 := &layers.IPv4{}
+	if err := ipv4.DecodeFromBytes(quoted,
+		gopacket.NilDecodeFeedback); err != nil {
+		return false
 	}
-	udp, _ := udpLayer.(*layers.UDP)
+	return s.handleQuoted(ipv4.SrcIP, ipv4.DstIP, ipv4.Protocol,
+		ipv4.Payload)
+}
 
-	// check ports
-	if udp.SrcPort != layers.UDPPort(s.test.SrcPort) ||
-		udp.DstPort != layers.UDPPort(s.test.DstPort) {
-		return
+// handleQuotedIPv6 checks if the ipv6 packet quoted in an icmp error message
+// matches the test packet
+func (s *sender) handleQuotedIPv6(quoted []byte) bool {
+	ipv6 := &layers.IPv6{}
+	if err := ipv6.DecodeFromBytes(quoted,
+		gopacket.NilDecodeFeedback); err != nil {
+		return false
 	}
+	return s.handleQuoted(ipv6.SrcIP, ipv6.DstIP, ipv6.NextHeader,
+		ipv6.Payload)
+}
 
-	// create result based on icmp code
-	result := &MessageResult{
-		ID:     s.test.ID,
-		Packet: packet.Data(),
+// getICMPv4Result returns the test result of icmpv4 error message type code
+func getICMPv4Result(typeCode layers.ICMPv4TypeCode) uint8 {
+	switch typeCode.Type() {
+	case layers.ICMPv4TypeTimeExceeded:
+		if typeCode.Code() == layers.ICMPv4CodeFragmentReassemblyTimeExceeded {
+			return ResultICMPv4ReassemblyExceeded
+		}
+		return ResultICMPv4TTLExceeded
+	case layers.ICMPv4TypeParameterProblem:
+		return ResultICMPv4ParameterProblem
+	case layers.ICMPv4TypeRedirect:
+		return ResultICMPv4Redirect
 	}
-	switch code := icmpv4.TypeCode.Code(); code {
+
+	switch code := typeCode.Code(); code {
 	case layers.ICMPv4CodeNet:
-		result.Result = ResultICMPv4NetworkUnreachable
+		return ResultICMPv4NetworkUnreachable
 	case layers.ICMPv4CodeHost:
-		result.Result = ResultICMPv4HostUnreachable
+		return ResultICMPv4HostUnreachable
 	case layers.ICMPv4CodeProtocol:
-		result.Result = ResultICMPv4ProtocolUnreachable
+		return ResultICMPv4ProtocolUnreachable
 	case layers.ICMPv4CodePort:
-		result.Result = ResultICMPv4PortUnreachable
+		return ResultICMPv4PortUnreachable
 	case layers.ICMPv4CodeFragmentationNeeded:
-		result.Result = ResultICMPv4FragmentationNeeded
+		return ResultICMPv4FragmentationNeeded
 	case layers.ICMPv4CodeSourceRoutingFailed:
-		result.Result = ResultICMPv4SourceRoutingFailed
+		return ResultICMPv4SourceRoutingFailed
 	case layers.ICMPv4CodeNetUnknown:
-		result.Result = ResultICMPv4NetworkUnknown
+		return ResultICMPv4NetworkUnknown
 	case layers.ICMPv4CodeHostUnknown:
-		result.Result = ResultICMPv4HostUnknown
+		return ResultICMPv4HostUnknown
 	case layers.ICMPv4CodeSourceIsolated:
-		result.Result = ResultICMPv4SourceIsolated
+		return ResultICMPv4SourceIsolated
 	case layers.ICMPv4CodeNetAdminProhibited:
-		result.Result = ResultICMPv4NetworkProhibited
+		return ResultICMPv4NetworkProhibited
 	case layers.ICMPv4CodeHostAdminProhibited:
-		result.Result = ResultICMPv4HostProhibited
+		return ResultICMPv4HostProhibited
 	case layers.ICMPv4CodeNetTOS:
-		result.Result = ResultICMPv4NetworkTOS
+		return ResultICMPv4NetworkTOS
 	case layers.ICMPv4CodeHostTOS:
-		result.Result = ResultICMPv4HostTOS
+		return ResultICMPv4HostTOS
 	case layers.ICMPv4CodeCommAdminProhibited:
-		result.Result = ResultICMPv4CommProhibited
+		return ResultICMPv4CommProhibited
 	case layers.ICMPv4CodeHostPrecedence:
-		result.Result = ResultICMPv4HostPrecedence
+		return ResultICMPv4HostPrecedence
 	case layers.ICMPv4CodePrecedenceCutoff:
-		result.Result = ResultICMPv4PrecedenceCutoff
+		return ResultICMPv4PrecedenceCutoff
 	default:
-		log.Println("unexpected icmpv4 type code:", code)
+		log.Println("unexpected icmpv4 type code:", typeCode)
 	}
-
-	// send result back to server
-	s.results <- result
+	return ResultNone
 }
 
-// handleICMPv6 handles ICMPv6 destination unreachable messages
-func (s *sender) handleICMPv6(packet gopacket.Packet) {
+// handleICMPv4 handles ICMPv4 destination unreachable, time exceeded,
+// parameter problem and redirect messages
+func (s *sender) handleICMPv4(packet gopacket.Packet) {
 	// handle icmp messages only
-	icmpv6Layer := packet.Layer(layers.LayerTypeICMPv6)
-	if icmpv6Layer == nil {
-		return
-	}
-	icmpv6, _ := icmpv6Layer.(*layers.ICMPv6)
-
-	// handle destination unreachable messages only
-	if icmpv6.TypeCode.Type() != layers.ICMPv6TypeDestinationUnreachable {
+	icmpv4Layer := packet.Layer(layers.LayerTypeICMPv4)
+	if icmpv4Layer == nil {
 		return
 	}
+	icmpv4, _ := icmpv4Layer.(*layers.ICMPv4)
 
-	// get encapsulated packet headers, skipping first 4 bytes (unused)
-	encap := gopacket.NewPacket(icmpv6.Payload[4:], layers.LayerTypeIPv6,
-		gopacket.Default)
-
-	// get encapsulated ip header
-	ipv6Layer := encap.Layer(layers.LayerTypeIPv6)
-	if ipv6Layer == nil {
+	// handle error messages only
+	switch icmpv4.TypeCode.Type() {
+	case layers.ICMPv4TypeDestinationUnreachable,
+		layers.ICMPv4TypeTimeExceeded,
+		layers.ICMPv4TypeParameterProblem,
+		layers.ICMPv4TypeRedirect:
+	default:
 		return
 	}
-	ipv6, _ := ipv6Layer.(*layers.IPv6)
 
-	// check ip addresses
-	if !ipv6.SrcIP.Equal(s.test.SrcIP) || !ipv6.DstIP.Equal(s.test.DstIP) {
+	// check encapsulated packet headers
+	if !s.handleQuotedIPv4(icmpv4.Payload) {
 		return
 	}
 
-	// get encapsulated udp header
-	udpLayer := encap.Layer(layers.LayerTypeUDP)
-	if udpLayer == nil {
-		return
+	// send result based on icmp type and code back to server
+	s.results <- &MessageResult{
+		ID:     s.test.ID,
+		Run:    s.test.Run,
+		Role:   RoleSender,
+		Result: getICMPv4Result(icmpv4.TypeCode),
+		Packet: packet.Data(),
+		Time:   packet.Metadata().Timestamp,
 	}
-	udp, _ := udpLayer.(*layers.UDP)
+}
 
-	// check ports
-	if udp.SrcPort != layers.UDPPort(s.test.SrcPort) ||
-		udp.DstPort != layers.UDPPort(s.test.DstPort) {
-		return
+// getICMPv6Result returns the test result of icmpv6 error message type code
+func getICMPv6Result(typeCode layers.ICMPv6TypeCode) uint8 {
+	switch typeCode.Type() {
+	case layers.ICMPv6TypePacketTooBig:
+		return ResultICMPv6PacketTooBig
+	case layers.ICMPv6TypeTimeExceeded:
+		if typeCode.Code() == layers.ICMPv6CodeFragmentReassemblyTimeExceeded {
+			return ResultICMPv6ReassemblyExceeded
+		}
+		return ResultICMPv6HopLimitExceeded
+	case layers.ICMPv6TypeParameterProblem:
+		return ResultICMPv6ParameterProblem
+	case layers.ICMPv6TypeRedirect:
+		return ResultICMPv6Redirect
 	}
 
-	// create result based on icmp code
-	result := &MessageResult{
-		ID:     s.test.ID,
-		Packet: packet.Data(),
-	}
-	switch code := icmpv6.TypeCode.Code(); code {
+	switch code := typeCode.Code(); code {
 	case layers.ICMPv6CodeNoRouteToDst:
-		result.Result = ResultICMPv6NoRouteToDst
+		return ResultICMPv6NoRouteToDst
 	case layers.ICMPv6CodeAdminProhibited:
-		result.Result = ResultICMPv6AdminProhibited
+		return ResultICMPv6AdminProhibited
 	case layers.ICMPv6CodeBeyondScopeOfSrc:
-		result.Result = ResultICMPv6BeyondScopeOfSrc
+		return ResultICMPv6BeyondScopeOfSrc
 	case layers.ICMPv6CodeAddressUnreachable:
-		result.Result = ResultICMPv6AddressUnreachable
+		return ResultICMPv6AddressUnreachable
 	case layers.ICMPv6CodePortUnreachable:
-		result.Result = ResultICMPv6PortUnreachable
+		return ResultICMPv6PortUnreachable
 	case layers.ICMPv6CodeSrcAddressFailedPolicy:
-		result.Result = ResultICMPv6SrcAddressFailed
+		return ResultICMPv6SrcAddressFailed
 	case layers.ICMPv6CodeRejectRouteToDst:
-		result.Result = ResultICMPv6RejectRouteToDst
+		return ResultICMPv6RejectRouteToDst
+	case icmpv6CodeSrcRoutingHeader:
+		return ResultICMPv6SrcRoutingHeader
+	case icmpv6CodeHeadersTooLong:
+		return ResultICMPv6HeadersTooLong
 	default:
-		log.Println("unexpected icmpv6 type code:", code)
+		log.Println("unexpected icmpv6 type code:", typeCode)
 	}
+	return ResultNone
+}
 
-	// send result back to server
-	s.results <- result
+// getICMPv6Quoted returns the packet quoted in icmpv6 error message icmpv6 of
+// packet
+func getICMPv6Quoted(packet gopacket.Packet, icmpv6 *layers.ICMPv6) []byte {
+	// redirect messages contain the packet in the redirected header
+	// option, skipping the first 6 bytes (reserved)
+	if icmpv6.TypeCode.Type() == layers.ICMPv6TypeRedirect {
+		redirectLayer := packet.Layer(layers.LayerTypeICMPv6Redirect)
+		if redirectLayer == nil {
+			return nil
+		}
+		redirect, _ := redirectLayer.(*layers.ICMPv6Redirect)
+		for _, o := range redirect.Options {
+			if o.Type == layers.ICMPv6OptRedirectedHeader &&
+				len(o.Data) > 6 {
+				return o.Data[6:]
+			}
+		}
+		return nil
+	}
+
+	// other messages contain the packet after the first 4 bytes (unused,
+	// mtu or pointer)
+	if len(icmpv6.Payload) < 4 {
+		return nil
+	}
+	return icmpv6.Payload[4:]
+}
+
+// handleICMPv6 handles ICMPv6 destination unreachable, packet too big, time
+// exceeded, parameter problem and redirect messages
+func (s *sender) handleICMPv6(packet gopacket.Packet) {
+	// handle icmp messages only
+	icmpv6Layer := packet.Layer(layers.LayerTypeICMPv6)
+	if icmpv6Layer == nil {
+		return
+	}
+	icmpv6, _ := icmpv6Layer.(*layers.ICMPv6)
+
+	// handle error messages only
+	switch icmpv6.TypeCode.Type() {
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem,
+		layers.ICMPv6TypeRedirect:
+	default:
+		return
+	}
+
+	// check encapsulated packet headers
+	if !s.handleQuotedIPv6(getICMPv6Quoted(packet, icmpv6)) {
+		return
+	}
+
+	// send result based on icmp type and code back to server
+	s.results <- &MessageResult{
+		ID:     s.test.ID,
+		Run:    s.test.Run,
+		Role:   RoleSender,
+		Result: getICMPv6Result(icmpv6.TypeCode),
+		Packet: packet.Data(),
+		Time:   packet.Metadata().Timestamp,
+	}
 }
 
 // handleTCPReset handles TCP reset messages
@@ -404,8 +543,11 @@ func (s *sender) handleTCPReset(packet gopacket.Packet) {
 	// send result back to server
 	s.results <- &MessageResult{
 		ID:     s.test.ID,
+		Run:    s.test.Run,
+		Role:   RoleSender,
 		Result: ResultTCPReset,
 		Packet: packet.Data(),
+		Time:   packet.Metadata().Timestamp,
 	}
 }
 
@@ -424,10 +566,14 @@ func (s *sender) sendPacket() {
 	if err := s.listener.send(s.packet); err != nil {
 		s.results <- &MessageResult{
 			ID:     s.test.ID,
+			Run:    s.test.Run,
+			Role:   RoleSender,
 			Result: ResultError,
 		}
 		log.Println(err)
+		return
 	}
+	metrics.add(MetricPacketsSent, 1, "device", s.test.Device)
 }
 
 // run runs the sender
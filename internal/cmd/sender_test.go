@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// TestSenderHandlePacket tests handling icmp error messages quoting tcp and
+// udp test packets
+func TestSenderHandlePacket(t *testing.T) {
+	newTest := func(protocol uint16, src, dst string) *MessageTest {
+		return &MessageTest{
+			ID:       42,
+			SrcMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			SrcIP:    net.ParseIP(src),
+			DstIP:    net.ParseIP(dst),
+			Protocol: protocol,
+			SrcPort:  4242,
+			DstPort:  1024,
+		}
+	}
+	eth := func(t layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			EthernetType: t,
+		}
+	}
+	icmpv4 := func(test *MessageTest, typeCode layers.ICMPv4TypeCode,
+		quoted []byte) []byte {
+		return getExampleRejectPacket(
+			eth(layers.EthernetTypeIPv4),
+			&layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				Protocol: layers.IPProtocolICMPv4,
+				SrcIP:    net.ParseIP("10.0.1.254"),
+				DstIP:    test.SrcIP,
+			},
+			&layers.ICMPv4{TypeCode: typeCode},
+			gopacket.Payload(quoted),
+		)
+	}
+	icmpv6 := func(test *MessageTest, typeCode layers.ICMPv6TypeCode,
+		quoted []byte) []byte {
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      net.ParseIP("fd00:1::fe"),
+			DstIP:      test.SrcIP,
+		}
+		icmp := &layers.ICMPv6{TypeCode: typeCode}
+		if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatal(err)
+		}
+		return getExampleRejectPacket(
+			eth(layers.EthernetTypeIPv6),
+			ip,
+			icmp,
+			gopacket.Payload(append([]byte{0, 0, 5, 0}, quoted...)),
+		)
+	}
+
+	tcp4 := newTest(ProtocolTCP, "10.0.1.1", "10.0.2.2")
+	udp4 := newTest(ProtocolUDP, "10.0.1.1", "10.0.2.2")
+	tcp6 := newTest(ProtocolTCP, "fd00:1::1", "fd00:2::2")
+	other := newTest(ProtocolTCP, "10.0.1.1", "10.0.2.2")
+	other.ID = 43
+	other.DstPort = 1025
+	quote := func(test *MessageTest) []byte {
+		return newSenderPacket(test).bytes()[14:]
+	}
+
+	for i, tc := range []struct {
+		test   *MessageTest
+		packet []byte
+		want   uint8
+	}{
+		// icmpv4 errors quoting tcp and udp packets
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeDestinationUnreachable,
+			layers.ICMPv4CodeCommAdminProhibited), quote(tcp4)),
+			ResultICMPv4CommProhibited},
+		{udp4, icmpv4(udp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeDestinationUnreachable,
+			layers.ICMPv4CodePort), quote(udp4)),
+			ResultICMPv4PortUnreachable},
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeTimeExceeded,
+			layers.ICMPv4CodeTTLExceeded), quote(tcp4)[:28]),
+			ResultICMPv4TTLExceeded},
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeParameterProblem, 0), quote(tcp4)),
+			ResultICMPv4ParameterProblem},
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeRedirect, 1), quote(tcp4)),
+			ResultICMPv4Redirect},
+
+		// icmpv6 errors
+		{tcp6, icmpv6(tcp6, layers.CreateICMPv6TypeCode(
+			layers.ICMPv6TypeDestinationUnreachable,
+			layers.ICMPv6CodeAdminProhibited), quote(tcp6)),
+			ResultICMPv6AdminProhibited},
+		{tcp6, icmpv6(tcp6, layers.CreateICMPv6TypeCode(
+			layers.ICMPv6TypePacketTooBig, 0), quote(tcp6)),
+			ResultICMPv6PacketTooBig},
+		{tcp6, icmpv6(tcp6, layers.CreateICMPv6TypeCode(
+			layers.ICMPv6TypeTimeExceeded,
+			layers.ICMPv6CodeHopLimitExceeded), quote(tcp6)),
+			ResultICMPv6HopLimitExceeded},
+
+		// ignored messages
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeDestinationUnreachable,
+			layers.ICMPv4CodePort), quote(other)), ResultNone},
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeDestinationUnreachable,
+			layers.ICMPv4CodePort), quote(udp4)), ResultNone},
+		{tcp4, icmpv4(tcp4, layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeEchoReply, 0), quote(tcp4)), ResultNone},
+	} {
+		results := make(chan *MessageResult, 1)
+		s := &sender{test: tc.test, results: results}
+		s.HandlePacket(gopacket.NewPacket(tc.packet,
+			layers.LayerTypeEthernet, gopacket.Default))
+
+		got := uint8(ResultNone)
+		select {
+		case r := <-results:
+			got = r.Result
+		default:
+		}
+		if got != tc.want {
+			t.Errorf("%d: got %s, want %s", i, resultString(got),
+				resultString(tc.want))
+		}
+	}
+}
+
+// TestSenderRewrittenQuote tests handling icmp error messages quoting test
+// packets that were rewritten by a middlebox
+func TestSenderRewrittenQuote(t *testing.T) {
+	newTest := func(protocol uint16) *MessageTest {
+		return &MessageTest{
+			ID:       42,
+			SrcMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMAC:   net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			SrcIP:    net.ParseIP("10.0.1.1"),
+			DstIP:    net.ParseIP("10.0.2.2"),
+			Protocol: protocol,
+			SrcPort:  4242,
+			DstPort:  1024,
+		}
+	}
+	icmpv4 := func(test, quoted *MessageTest) []byte {
+		return getExampleRejectPacket(
+			&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+				DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+				EthernetType: layers.EthernetTypeIPv4,
+			},
+			&layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				Protocol: layers.IPProtocolICMPv4,
+				SrcIP:    net.ParseIP("10.0.2.254"),
+				DstIP:    test.SrcIP,
+			},
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(
+				layers.ICMPv4TypeDestinationUnreachable,
+				layers.ICMPv4CodeCommAdminProhibited)},
+			gopacket.Payload(newSenderPacket(quoted).bytes()[14:]),
+		)
+	}
+
+	tcp := newTest(ProtocolTCP)
+	udp := newTest(ProtocolUDP)
+	natTCP := newTest(ProtocolTCP)
+	natTCP.SrcIP = net.ParseIP("192.0.2.1")
+	natTCP.SrcPort = 5000
+	seqTCP := newTest(ProtocolTCP)
+	seqTCP.ID = 1042
+	natUDP := newTest(ProtocolUDP)
+	natUDP.DstIP = net.ParseIP("10.0.3.3")
+	natUDP.DstPort = 80
+	other := newTest(ProtocolTCP)
+	other.ID = 43
+	other.SrcIP = net.ParseIP("192.0.2.1")
+
+	for i, tc := range []struct {
+		test, quoted *MessageTest
+		want         string
+	}{
+		{tcp, natTCP, "rewritten SrcIP: 10.0.1.1 -> 192.0.2.1, " +
+			"rewritten SrcPort: 4242 -> 5000"},
+		{tcp, seqTCP, "rewritten Seq: 42 -> 1042"},
+		{udp, natUDP, "rewritten DstIP: 10.0.2.2 -> 10.0.3.3, " +
+			"rewritten DstPort: 1024 -> 80"},
+		{tcp, other, ""},
+	} {
+		results := make(chan *MessageResult, 1)
+		s := &sender{test: tc.test, results: results}
+		s.HandlePacket(gopacket.NewPacket(icmpv4(tc.test, tc.quoted),
+			layers.LayerTypeEthernet, gopacket.Default))
+
+		var r *MessageResult
+		select {
+		case r = <-results:
+		default:
+		}
+		if tc.want == "" {
+			if r != nil {
+				t.Errorf("%d: got %s, want none", i,
+					resultString(r.Result))
+			}
+			continue
+		}
+		if r == nil {
+			t.Errorf("%d: got no result", i)
+			continue
+		}
+
+		// check rewrites of the reject source
+		item := &planItem{ID: tc.test.ID, SenderMsg: tc.test}
+		source := item.getRejectSource(r).String()
+		if !strings.HasSuffix(source, tc.want) {
+			t.Errorf("%d: got %s, want %s", i, source, tc.want)
+		}
+	}
+}
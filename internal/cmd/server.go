@@ -1,11 +1,30 @@
 package cmd
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"slices"
 	"time"
 )
 
+const (
+	// ClientTimeout is the time after which a client that did not send
+	// any messages is considered dead
+	ClientTimeout = 3 * NopInterval * time.Second
+
+	// ClientReturnTimeout is the time the server waits for lost clients
+	// to return before it aborts the test plan
+	ClientReturnTimeout = 5 * time.Minute
+)
+
 // clientResult is a result sent by a client
 type clientResult struct {
 	clientID uint8
@@ -16,37 +35,117 @@ type clientResult struct {
 type clientHandler struct {
 	conn       net.Conn
 	id         uint8
+	reg        *MessageRegister
+	token      string
 	clientRegs chan *clientHandler
+	clientLost chan *clientHandler
 	results    chan *clientResult
+	timeout    time.Duration
+	lastSeen   time.Time
+	legacy     bool
 }
 
 // newClientHandler creates a new client handler with conn
-func newClientHandler(conn net.Conn, clientRegs chan *clientHandler,
+func newClientHandler(conn net.Conn, token string,
+	clientRegs, clientLost chan *clientHandler,
 	results chan *clientResult) *clientHandler {
 	return &clientHandler{
 		conn,
 		0,
+		nil,
+		token,
 		clientRegs,
+		clientLost,
 		results,
+		ClientTimeout,
+		time.Time{},
+		false,
 	}
 }
 
 // registerClient reads a client registration from client and returns ok
 func (c *clientHandler) registerClient() bool {
 	// read message from client
-	msg := readMessage(c.conn)
-	if msg == nil {
+	msg, legacy, err := readMessageFormat(c.conn)
+	if err != nil {
+		handleReadError(c.conn, err)
 		return false
 	}
+	c.legacy = legacy
 
 	// handle register message
 	if msg.GetType() != MessageTypeRegister {
+		reportProtocolError(c.conn, fmt.Sprintf(
+			"expected register message, got message type %d",
+			msg.GetType()))
 		return false
 	}
-	c.id = msg.(*MessageRegister).Client
+	reg := msg.(*MessageRegister)
+
+	// legacy clients do not send a token, protocol version and
+	// capabilities and do not expect replies; they support tcp and udp
+	// tests as sender and receiver
+	if c.legacy {
+		if c.token != "" {
+			log.Printf("Client %s uses legacy protocol without token",
+				c.conn.RemoteAddr())
+			return false
+		}
+		log.Printf("Client %s uses legacy protocol version %d",
+			c.conn.RemoteAddr(), ProtocolVersionLegacy)
+		reg.Version = ProtocolVersionLegacy
+		reg.Protocols = []uint16{ProtocolTCP, ProtocolUDP}
+		reg.Features = []string{FeatureSender, FeatureReceiver}
+		c.id = reg.Client
+		c.reg = reg
+		return true
+	}
+
+	// check token
+	if subtle.ConstantTimeCompare([]byte(reg.Token),
+		[]byte(c.token)) != 1 {
+		log.Printf("Client %s sent invalid token", c.conn.RemoteAddr())
+		c.sendRegisterReply(false, "invalid token", "")
+		return false
+	}
+
+	// check protocol version
+	if reg.Version != ProtocolVersion {
+		log.Printf("Client %s uses incompatible protocol version %d",
+			c.conn.RemoteAddr(), reg.Version)
+		c.sendRegisterReply(false, fmt.Sprintf(
+			"incompatible protocol version %d", reg.Version), "")
+		return false
+	}
+	c.id = reg.Client
+	c.reg = reg
 	return true
 }
 
+// writeMessage writes message to the client in the format of the client
+func (c *clientHandler) writeMessage(message Message) error {
+	if c.legacy {
+		return writeLegacyMessage(c.conn, message)
+	}
+	return writeMessage(c.conn, message)
+}
+
+// sendRegisterReply sends a registration reply with the session token to the
+// client; legacy clients do not get replies
+func (c *clientHandler) sendRegisterReply(accepted bool, reason,
+	session string) error {
+	if c.legacy {
+		return nil
+	}
+	reply := &MessageRegisterReply{
+		Accepted: accepted,
+		Version:  ProtocolVersion,
+		Reason:   reason,
+		Session:  session,
+	}
+	return c.writeMessage(reply)
+}
+
 // handleClient handles a client connection
 func (c *clientHandler) run() {
 	defer func() {
@@ -59,17 +158,35 @@ func (c *clientHandler) run() {
 	if ok := c.registerClient(); !ok {
 		return
 	}
+	log.Printf("Client %s registered with id %d (software version %s)",
+		c.conn.RemoteAddr(), c.id, c.reg.Software)
 	c.clientRegs <- c
-	log.Printf("Client %s registered with id %d", c.conn.RemoteAddr(),
-		c.id)
+	defer func() {
+		c.clientLost <- c
+	}()
 
 	// enter main loop
+	c.lastSeen = time.Now()
 	for {
-		// read message from client
-		msg := readMessage(c.conn)
-		if msg == nil {
-			break
+		// read message from client; clients send nop messages
+		// regularly, so a client that is silent for too long is
+		// considered dead
+		err := c.conn.SetReadDeadline(c.lastSeen.Add(c.timeout))
+		if err != nil {
+			log.Printf("Connection to %s: %s", c.conn.RemoteAddr(), err)
+			return
 		}
+		msg, err := readMessage(c.conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Client %d timed out, last seen at %s",
+				c.id, c.lastSeen.Format(time.RFC3339))
+			return
+		}
+		if err != nil {
+			handleReadError(c.conn, err)
+			return
+		}
+		c.lastSeen = time.Now()
 
 		// handle message based on type
 		switch msg.GetType() {
@@ -80,23 +197,74 @@ func (c *clientHandler) run() {
 			if !ok {
 				break
 			}
+			metrics.add(MetricResults, 1, "client",
+				fmt.Sprint(c.id), "result", resultString(m.Result))
+			metrics.add(MetricMessageBacklog, 1)
 			c.results <- &clientResult{c.id, m}
+			metrics.add(MetricMessageBacklog, -1)
+		case MessageTypeError:
+			// client reported an error; disconnect client
+			log.Printf("Client %s reported error: %s",
+				c.conn.RemoteAddr(), msg.(*MessageError).Reason)
+			return
 		default:
 			// invalid client message; disconnect client
-			log.Println("Invalid message from client",
-				c.conn.RemoteAddr())
-			break
+			reportProtocolError(c.conn, fmt.Sprintf(
+				"unexpected message type %d", msg.GetType()))
+			return
 		}
 	}
 }
 
+// Plan run states
+const (
+	RunStateQueued    = "queued"
+	RunStateRunning   = "running"
+	RunStateDone      = "done"
+	RunStateCancelled = "cancelled"
+	RunStateAborted   = "aborted"
+	RunStateFailed    = "failed"
+)
+
+// CollectTime is the time the server collects results after the last plan
+// item of a run
+const CollectTime = 5 * time.Second
+
+// planRun is a run of a test plan on the server
+type planRun struct {
+	id       int
+	plan     *plan
+	clients  []uint8
+	state    string
+	err      error
+	started  time.Time
+	finished time.Time
+	stopped  bool
+	abort    *time.Timer
+}
+
 // server stores information about a server
 type server struct {
-	listener   net.Listener
-	plan       *plan
-	clientRegs chan *clientHandler
-	clients    map[uint8]*clientHandler
-	results    chan *clientResult
+	listener    net.Listener
+	api         *http.Server
+	token       string
+	config      *Config
+	plan        *plan
+	clientRegs  chan *clientHandler
+	clientLost  chan *clientHandler
+	clients     map[uint8]*clientHandler
+	sessions    map[uint8]string
+	results     chan *clientResult
+	runs        []*planRun
+	active      []*planRun
+	queued      []*planRun
+	next        chan *queueNext
+	done        chan *planRun
+	aborts      chan *time.Timer
+	calls       chan func()
+	collectTime time.Duration
+	persistent  bool
+	tui         *tui
 }
 
 // listen waits for new connections from clients
@@ -111,126 +279,628 @@ func (s *server) listen() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		go newClientHandler(client, s.clientRegs, s.results).run()
+		go newClientHandler(client, s.token, s.clientRegs,
+			s.clientLost, s.results).run()
+	}
+}
+
+// newSession returns a new random session token
+func newSession() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// acceptClient checks the registration of client c and accepts or rejects
+// it; a client that registers again with the session token it received on
+// its first registration resumes its session and replaces its old
+// connection. A restarted client without session token starts a new session
+// and its plan items are restarted. It returns whether the client is accepted
+func (s *server) acceptClient(c *clientHandler) bool {
+	reject := func(reason string) bool {
+		log.Printf("Rejecting client %d: %s", c.id, reason)
+		_ = c.sendRegisterReply(false, reason, "")
+		_ = c.conn.Close()
+		return false
+	}
+
+	// check if client supports the plan; a persistent server keeps
+	// clients that are not part of its running plans for later plans
+	p := s.plan
+	if s.persistent {
+		p = nil
+		if r := s.getClientRun(c.id); r != nil {
+			p = r.plan
+		}
+	}
+	if p != nil {
+		if err := p.checkClient(c.id, c.reg); err != nil {
+			return reject(fmt.Sprintf(
+				"client does not support plan: %s", err))
+		}
+	}
+
+	// check session of returning client; a client without session
+	// token was restarted and gets a new session
+	session, ok := s.sessions[c.id]
+	if ok && c.reg.Session == "" {
+		log.Printf("Client %d was restarted, starting new session",
+			c.id)
+		ok = false
+	}
+	if ok && subtle.ConstantTimeCompare([]byte(c.reg.Session),
+		[]byte(session)) != 1 {
+		return reject("invalid session")
+	}
+	if !ok {
+		session = newSession()
+	}
+	if err := c.sendRegisterReply(true, "", session); err != nil {
+		log.Printf("Error sending to client %d: %s", c.id, err)
+		_ = c.conn.Close()
+		return false
+	}
+	s.sessions[c.id] = session
+
+	// replace old connection of returning client
+	if old := s.clients[c.id]; old != nil {
+		log.Printf("Client %d replaces connection %s",
+			c.id, old.conn.RemoteAddr())
+		_ = old.conn.Close()
+	}
+	if ok {
+		log.Printf("Client %d resumed session", c.id)
+	}
+	s.clients[c.id] = c
+	metrics.set(MetricClientsConnected, float64(len(s.clients)))
+	return true
+}
+
+// sendTest sends test to the client with clientID; if the client is not
+// connected, the test is dispatched again when the client returns
+func (s *server) sendTest(clientID uint8, test *MessageTest) {
+	c := s.clients[clientID]
+	if c == nil {
+		return
+	}
+	if err := c.writeMessage(test); err != nil {
+		log.Printf("Error sending to client %d: %s", clientID, err)
+		_ = c.conn.Close()
+	}
+}
+
+// queueNext moves queue on to its next plan item; it is ignored if the
+// current item of queue was restarted in the meantime
+type queueNext struct {
+	queue      *planQueue
+	generation uint32
+}
+
+// startQueue dispatches the current item of queue q of plan p to its
+// receiver, if the sender and receiver of q are active; the item is reset
+// first in case clients returned during the item. Items that were already
+// sent are not restarted, the queue moves on to the next item instead
+func (s *server) startQueue(p *plan, q *planQueue) {
+	if !p.queueActive(q) || q.isCurrentItemSent() {
+		return
+	}
+	item := q.restartCurrentItem()
+	if item == nil {
+		return
+	}
+	if !q.started {
+		log.Printf("Starting plan items of sender %d and receiver %d",
+			q.senderID, q.receiverID)
+		q.started = true
+	} else {
+		log.Printf("Resuming plan items of sender %d and receiver %d "+
+			"at item %d", q.senderID, q.receiverID, item.ID)
+	}
+	s.sendReceiverTests(item)
+}
+
+// sendReceiverTests sends the receiver tests of item to its receiver and
+// hops; if item has no receiver, it sends the sender test right away
+func (s *server) sendReceiverTests(item *planItem) {
+	item.dispatchTime = time.Now()
+	if item.ReceiverMsg == nil && len(item.Hops) == 0 {
+		s.sendSenderTest(item)
+		return
+	}
+	for _, h := range item.Hops {
+		s.sendTest(h.ReceiverID, h.ReceiverMsg)
+	}
+	s.sendTest(item.ReceiverID, item.ReceiverMsg)
+}
+
+// sendSenderTest sends the sender test of item to its sender and moves on to
+// the next item in the queue of item
+func (s *server) sendSenderTest(item *planItem) {
+	q := item.queue
+	item.SendTime = time.Now()
+	s.sendTest(q.senderID, item.SenderMsg)
+	next := &queueNext{q, q.generation}
+	go func() {
+		// wait ten millisecond and trigger next plan item
+		time.Sleep(10 * time.Millisecond)
+		s.next <- next
+	}()
+}
+
+// call runs f in the event loop of the server and waits until it returns
+func (s *server) call(f func()) {
+	done := make(chan struct{})
+	s.calls <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// getRun returns the plan run with id
+func (s *server) getRun(id int) *planRun {
+	if id < 1 || id > len(s.runs) {
+		return nil
+	}
+	return s.runs[id-1]
+}
+
+// getClientRun returns the running plan run of the client with clientID
+func (s *server) getClientRun(clientID uint8) *planRun {
+	for _, r := range s.active {
+		if slices.Contains(r.clients, clientID) {
+			return r
+		}
+	}
+	return nil
+}
+
+// getQueueRun returns the running plan run of queue q
+func (s *server) getQueueRun(q *planQueue) *planRun {
+	for _, r := range s.active {
+		if slices.Contains(r.plan.queues, q) {
+			return r
+		}
+	}
+	return nil
+}
+
+// checkClients checks if the connected clients support plan p
+func (s *server) checkClients(p *plan) error {
+	for id, c := range s.clients {
+		if !p.hasClient(id) {
+			continue
+		}
+		if err := p.checkClient(id, c.reg); err != nil {
+			return fmt.Errorf("client %d does not support plan: %w",
+				id, err)
+		}
 	}
+	return nil
 }
 
-// run runs this server
+// queueRun checks plan p and queues it for running; queued plans run in
+// order as soon as their clients are not used by other running plans
+func (s *server) queueRun(p *plan) (*planRun, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	if err := s.checkClients(p); err != nil {
+		return nil, err
+	}
+	r := &planRun{
+		id:      len(s.runs) + 1,
+		plan:    p,
+		clients: p.getClients(),
+		state:   RunStateQueued,
+	}
+	p.setRun(uint32(r.id))
+	s.runs = append(s.runs, r)
+	s.queued = append(s.queued, r)
+	log.Printf("Queued test plan %d with clients %v", r.id, r.clients)
+	s.startRuns()
+	return r, nil
+}
+
+// startRuns starts all queued plan runs whose clients are neither used by
+// running plans nor by plans queued before them
+func (s *server) startRuns() {
+	busy := make(map[uint8]bool)
+	for _, r := range s.active {
+		for _, id := range r.clients {
+			busy[id] = true
+		}
+	}
+	queued := []*planRun{}
+	for _, r := range s.queued {
+		if slices.ContainsFunc(r.clients, func(id uint8) bool {
+			return busy[id]
+		}) {
+			queued = append(queued, r)
+		} else if err := s.startRun(r); err != nil {
+			log.Printf("Error starting test plan %d: %s", r.id, err)
+			r.state = RunStateFailed
+			r.err = err
+			r.finished = time.Now()
+			continue
+		}
+		for _, id := range r.clients {
+			busy[id] = true
+		}
+	}
+	s.queued = queued
+}
+
+// startRun starts running plan run r with the connected clients
+func (s *server) startRun(r *planRun) error {
+	p := r.plan
+	if err := s.checkClients(p); err != nil {
+		return err
+	}
+	r.state = RunStateRunning
+	r.started = time.Now()
+	s.active = append(s.active, r)
+
+	log.Printf("Starting test plan %d with %d items and %d sender and "+
+		"receiver pairs", r.id, len(p.items), len(p.queues))
+	for id := range s.clients {
+		if p.hasClient(id) {
+			p.handleClient(id)
+		}
+	}
+	for _, q := range p.queues {
+		s.startQueue(p, q)
+	}
+	return nil
+}
+
+// cancelRun cancels the queued or running plan run r; it returns false if r
+// is not queued or running
+func (s *server) cancelRun(r *planRun) bool {
+	switch {
+	case r.state == RunStateQueued:
+		s.queued = slices.DeleteFunc(s.queued, func(q *planRun) bool {
+			return q == r
+		})
+		r.state = RunStateCancelled
+		r.finished = time.Now()
+		log.Printf("Cancelled test plan %d", r.id)
+		return true
+	case slices.Contains(s.active, r) && !r.stopped:
+		log.Printf("Cancelling test plan %d", r.id)
+		s.stopRun(r, RunStateCancelled)
+		return true
+	}
+	return false
+}
+
+// stopRun stops dispatching the plan items of plan run r and collects the
+// remaining results before r finishes with state
+func (s *server) stopRun(r *planRun, state string) {
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	r.state = state
+	s.stopAbort(r)
+	log.Printf("Collecting results of test plan %d for %s...", r.id,
+		s.collectTime)
+	go func() {
+		time.Sleep(s.collectTime)
+		s.done <- r
+	}()
+}
+
+// finishRun finishes plan run r and starts queued plan runs
+func (s *server) finishRun(r *planRun) {
+	s.stopAbort(r)
+	r.finished = time.Now()
+	for _, item := range r.plan.getResultItems() {
+		metrics.add(MetricItemVerdicts, 1, "verdict",
+			planResultString(item.getResult()))
+	}
+	s.active = slices.DeleteFunc(s.active, func(a *planRun) bool {
+		return a == r
+	})
+	log.Printf("Test plan %d %s", r.id, r.state)
+	s.startRuns()
+}
+
+// startAbort starts the timer that aborts plan run r if its lost clients
+// do not return in time
+func (s *server) startAbort(r *planRun) {
+	var t *time.Timer
+	t = time.AfterFunc(ClientReturnTimeout, func() {
+		s.aborts <- t
+	})
+	r.abort = t
+}
+
+// stopAbort stops the abort timer of plan run r
+func (s *server) stopAbort(r *planRun) {
+	if r.abort != nil {
+		r.abort.Stop()
+		r.abort = nil
+	}
+}
+
+// handleClientReg handles the registration of client c
+func (s *server) handleClientReg(c *clientHandler) {
+	if !s.acceptClient(c) {
+		return
+	}
+	r := s.getClientRun(c.id)
+	if r == nil {
+		return
+	}
+
+	// handle client in plan
+	r.plan.handleClient(c.id)
+
+	// stop waiting for lost clients
+	if r.plan.clientsActive() {
+		s.stopAbort(r)
+	}
+
+	// start or resume the queues of the client, if their sender and
+	// receiver are active
+	if r.stopped {
+		return
+	}
+	for _, q := range r.plan.getQueues(c.id) {
+		s.startQueue(r.plan, q)
+	}
+}
+
+// handleClientLost handles the lost connection of client c
+func (s *server) handleClientLost(c *clientHandler) {
+	// ignore old connections of returning clients
+	if s.clients[c.id] != c {
+		return
+	}
+	delete(s.clients, c.id)
+	metrics.set(MetricClientsConnected, float64(len(s.clients)))
+	r := s.getClientRun(c.id)
+	if r == nil {
+		return
+	}
+	r.plan.handleClientLost(c.id)
+	started := false
+	for _, q := range r.plan.getQueues(c.id) {
+		started = started || q.started
+	}
+	if !started || r.stopped || r.abort != nil {
+		return
+	}
+	log.Printf("Lost connection to client %d, pausing its plan items "+
+		"for up to %s until it returns", c.id, ClientReturnTimeout)
+	s.startAbort(r)
+}
+
+// handleAbort aborts the plan run with the abort timer t
+func (s *server) handleAbort(t *time.Timer) {
+	for _, r := range s.active {
+		if r.abort != t {
+			continue
+		}
+
+		// lost clients did not return in time
+		log.Printf("Aborting test plan %d: clients did not return "+
+			"within %s", r.id, ClientReturnTimeout)
+		r.state = RunStateAborted
+		s.finishRun(r)
+		return
+	}
+}
+
+// handleResult handles the result cr sent by a client
+func (s *server) handleResult(cr *clientResult) {
+	r := s.getClientRun(cr.clientID)
+	if r == nil {
+		return
+	}
+
+	// ignore late results of other runs; clients that do not support run
+	// ids send 0
+	if cr.result.Run != 0 && cr.result.Run != uint32(r.id) {
+		return
+	}
+
+	// handle result in plan
+	r.plan.handleResult(cr.clientID, cr.result)
+
+	// only handle the current item of the queue
+	item := r.plan.items[cr.result.ID]
+	if item == nil || item.queue.getCurrentItem() != item {
+		return
+	}
+
+	// if receiver and hops are ready, inform sender and move on to next
+	// item in the queue
+	if cr.result.Result == ResultReady && item.isReady() &&
+		r.plan.queueActive(item.queue) && !r.stopped {
+		s.sendSenderTest(item)
+	}
+}
+
+// handleNext moves the queue of next on to its next plan item
+func (s *server) handleNext(next *queueNext) {
+	// ignore stale events of restarted items
+	q := next.queue
+	if next.generation != q.generation {
+		return
+	}
+
+	// ignore queues of finished and stopped runs
+	r := s.getQueueRun(q)
+	if r == nil || r.stopped {
+		return
+	}
+
+	// complete current plan item
+	if item := q.getCurrentItem(); item != nil {
+		metrics.add(MetricItemsCompleted, 1)
+		metrics.observe(MetricItemLatency,
+			time.Since(item.dispatchTime).Seconds())
+	}
+
+	// go to next plan item in the queue
+	item := q.getNextItem()
+	if item == nil {
+		log.Printf("No more items for sender %d and receiver %d",
+			q.senderID, q.receiverID)
+		if r.plan.isDone() {
+			log.Printf("No more items in test plan %d", r.id)
+			s.stopRun(r, RunStateDone)
+		}
+		return
+	}
+	numItems := uint32(len(r.plan.items))
+	percentItems := max(numItems/100, 1)
+	if item.ID%percentItems == 0 {
+		percent := float32(item.ID) / float32(numItems) * 100
+		log.Printf("Reached plan item %d/%d (%.0f%%)",
+			item.ID, numItems, percent)
+	}
+
+	// inform receiver; if clients are not active, the item is dispatched
+	// when they return
+	if r.plan.queueActive(q) {
+		s.sendReceiverTests(item)
+	}
+}
+
+// run runs this server; without http api, it runs its plan and returns
+// when the plan is done
 func (s *server) run() {
+	if !s.persistent && len(s.plan.items) == 0 {
+		log.Println("No items in plan")
+		return
+	}
+
 	go s.listen()
+	if s.api != nil {
+		go s.serveAPI()
+	}
 
-	numItems := uint32(len(s.plan.items))
-	percentItems := uint32(numItems / 100)
-	if percentItems == 0 {
-		percentItems++
+	// show progress in terminal ui; the log is only shown in the
+	// terminal ui while the server runs
+	var tick <-chan time.Time
+	if s.tui != nil {
+		ticker := time.NewTicker(TUIInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		log.SetOutput(s.tui)
+		defer log.SetOutput(os.Stderr)
+		s.tui.render(s)
+	}
+
+	if s.plan != nil {
+		if _, err := s.queueRun(s.plan); err != nil {
+			log.Fatal(err)
+		}
 	}
-	next := make(chan struct{})
-	done := make(chan struct{})
 	for {
 		select {
+		case <-tick:
+			s.tui.render(s)
+
 		case c := <-s.clientRegs:
-			s.clients[c.id] = c
-
-			// handle client in plan
-			s.plan.handleClient(c.id)
-
-			// if all clients are active, get first item in the
-			// plan and inform receiver
-			if s.plan.clientsActive() {
-				// get first item
-				item := s.plan.getCurrentItem()
-				if item == nil {
-					log.Println("No items in plan")
-					return
-				}
-
-				// inform user we are starting with the test plan
-				log.Printf("Starting test plan with %d items",
-					numItems)
-
-				// inform receiver
-				msg := item.ReceiverMsg
-				receiver := s.clients[s.plan.receiverID]
-				if !writeMessage(receiver.conn, msg) {
-					log.Println("Error sending to receiver client")
-					return
-				}
-			}
+			s.handleClientReg(c)
 
-		case r := <-s.results:
-			// handle result in plan
-			s.plan.handleResult(r.clientID, r.result)
+		case c := <-s.clientLost:
+			s.handleClientLost(c)
 
-			// if there is no (more) item in the plan, stop here
-			item := s.plan.getCurrentItem()
-			if item == nil {
-				continue
+		case t := <-s.aborts:
+			s.handleAbort(t)
+			if !s.persistent && len(s.active) == 0 {
+				return
 			}
 
-			// if receiver is ready, inform sender and
-			// move on to next item in the plan
-			if r.result.Result == ResultReady && item.receiverReady {
-				// inform sender
-				msg := item.SenderMsg
-				sender := s.clients[s.plan.senderID]
-				if !writeMessage(sender.conn, msg) {
-					log.Println("Error sending to sender client")
-					return
-				}
-				go func() {
-					// wait ten millisecond and trigger
-					// next plan item
-					time.Sleep(10 * time.Millisecond)
-					next <- struct{}{}
-				}()
-			}
+		case r := <-s.results:
+			s.handleResult(r)
+
+		case next := <-s.next:
+			s.handleNext(next)
 
-		case <-next:
-			// go to next plan item
-			item := s.plan.getNextItem()
-			if item == nil {
-				log.Println("No more items in plan")
-				log.Println("Collecting results for 5 seconds...")
-				go func() {
-					time.Sleep(5 * time.Second)
-					done <- struct{}{}
-				}()
+		case r := <-s.done:
+			// ignore aborted plan runs
+			if !slices.Contains(s.active, r) {
 				continue
 			}
-			if item.ID%percentItems == 0 {
-				percent := float32(item.ID) / float32(numItems) * 100
-				log.Printf("Reached plan item %d/%d (%.0f%%)",
-					item.ID, numItems, percent)
-			}
-			msg := item.ReceiverMsg
-			receiver := s.clients[s.plan.receiverID]
-			if !writeMessage(receiver.conn, msg) {
-				log.Println("Error sending to receiver client")
+			s.finishRun(r)
+			if !s.persistent {
+				// shut down server
+				log.Println("Shutting down...")
 				return
 			}
 
-		case <-done:
-			// shut down server
-			log.Println("Shutting down...")
-			return
+		case f := <-s.calls:
+			f()
 		}
 	}
 }
 
-// newServer creates an new server that listens on address
-func newServer(address string, plan *plan) *server {
+// newServer creates an new server that listens on the server address in
+// config; if config contains an http api address, the server runs until it
+// is stopped, keeps its clients between plans and runs the plans submitted
+// via the http api instead of plan
+func newServer(config *Config, plan *plan) *server {
 	// create listener
-	listener, err := net.Listen("tcp", address)
+	var listener net.Listener
+	var err error
+	if tlsConfig := newServerTLSConfig(config); tlsConfig != nil {
+		listener, err = tls.Listen("tcp", config.ServerAddress,
+			tlsConfig)
+	} else {
+		log.Println("Server not using TLS")
+		listener, err = net.Listen("tcp", config.ServerAddress)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// return server
-	return &server{
+	// create server
+	s := &server{
 		listener,
+		nil,
+		config.Token,
+		config,
 		plan,
 		make(chan *clientHandler),
+		make(chan *clientHandler),
 		make(map[uint8]*clientHandler),
+		make(map[uint8]string),
 		make(chan *clientResult),
+		nil,
+		nil,
+		nil,
+		make(chan *queueNext),
+		make(chan *planRun),
+		make(chan *time.Timer),
+		make(chan func()),
+		CollectTime,
+		false,
+		nil,
+	}
+	if config.TUI {
+		s.tui = newTUI(os.Stdout)
+	}
+	if config.APIAddress != "" {
+		tlsConfig := newServerTLSConfig(config)
+		err := checkAPIAuth(config.APIAddress, tlsConfig, config.Token)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.api = &http.Server{
+			Addr:      config.APIAddress,
+			Handler:   s.newAPIHandler(),
+			TLSConfig: tlsConfig,
+		}
+		s.plan = nil
+		s.persistent = true
 	}
+	return s
 }
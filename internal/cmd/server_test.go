@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRegisterClient tests registering clients with tokens
+func TestRegisterClient(t *testing.T) {
+	test := func(serverToken, clientToken string, want bool) {
+		in, out := net.Pipe()
+		if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			msg := &MessageRegister{
+				Client:  1,
+				Token:   clientToken,
+				Version: ProtocolVersion,
+			}
+			_ = writeMessage(in, msg)
+			_, _ = readMessage(in)
+		}()
+		c := newClientHandler(out, serverToken, nil, nil, nil)
+		got := c.registerClient()
+		if got != want {
+			t.Errorf("got %t, want %t", got, want)
+		}
+	}
+
+	test("", "", true)
+	test("secret", "secret", true)
+	test("secret", "", false)
+	test("secret", "other", false)
+	test("", "secret", false)
+}
+
+// TestRegisterClientVersion tests registering clients with protocol versions
+func TestRegisterClientVersion(t *testing.T) {
+	test := func(version uint16, want bool) {
+		in, out := net.Pipe()
+		if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		replies := make(chan Message, 1)
+		go func() {
+			msg := &MessageRegister{Client: 1, Version: version}
+			_ = writeMessage(in, msg)
+			if !want {
+				reply, _ := readMessage(in)
+				replies <- reply
+			}
+		}()
+		c := newClientHandler(out, "", nil, nil, nil)
+		got := c.registerClient()
+		if got != want {
+			t.Errorf("got %t, want %t", got, want)
+		}
+		if !want {
+			reply := (<-replies).(*MessageRegisterReply)
+			if reply.Accepted || reply.Version != ProtocolVersion {
+				t.Errorf("got %v, want rejection", reply)
+			}
+		}
+	}
+
+	test(ProtocolVersion, true)
+	test(0, false)
+	test(ProtocolVersion+1, false)
+}
+
+// TestRegisterLegacyClient tests registering clients that use the legacy
+// message format and sending tests to them in the legacy format
+func TestRegisterLegacyClient(t *testing.T) {
+	test := func(serverToken string, want bool) {
+		in, out := net.Pipe()
+		if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if err := in.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = writeLegacyMessage(in, &MessageRegister{Client: 1})
+		}()
+		c := newClientHandler(out, serverToken, nil, nil, nil)
+		got := c.registerClient()
+		if got != want {
+			t.Errorf("got %t, want %t", got, want)
+		}
+		if !want {
+			return
+		}
+		if c.reg.Version != ProtocolVersionLegacy ||
+			!c.reg.hasFeature(FeatureSender) {
+			t.Errorf("got %v, want legacy registration", c.reg)
+		}
+
+		// legacy clients get no register reply and legacy tests
+		go func() {
+			_ = c.sendRegisterReply(true, "", "session")
+			_ = c.writeMessage(&MessageTest{ID: 42})
+		}()
+		msg, legacy, err := readMessageFormat(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !legacy || msg.GetType() != MessageTypeTest {
+			t.Errorf("got %v, want legacy test message", msg)
+		}
+	}
+
+	test("", true)
+	test("secret", false)
+}
+
+// TestRegisterClientProtocolError tests reporting protocol errors during
+// client registration
+func TestRegisterClientProtocolError(t *testing.T) {
+	in, out := net.Pipe()
+	if err := out.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	replies := make(chan Message, 1)
+	go func() {
+		_ = writeMessage(in, &MessageNop{})
+		reply, _ := readMessage(in)
+		replies <- reply
+	}()
+	c := newClientHandler(out, "", nil, nil, nil)
+	if c.registerClient() {
+		t.Errorf("got true, want false")
+	}
+	reply, ok := (<-replies).(*MessageError)
+	if !ok || reply.Reason == "" {
+		t.Errorf("got %v, want error message", reply)
+	}
+}
+
+// TestAcceptClientSession tests accepting returning clients with sessions
+func TestAcceptClientSession(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	config.SenderDevice = "veth2"
+	config.ReceiverDevice = "veth4"
+	s := &server{
+		plan:     newPlan(config),
+		clients:  make(map[uint8]*clientHandler),
+		sessions: make(map[uint8]string),
+	}
+
+	test := func(session string, want bool) *MessageRegisterReply {
+		in, out := net.Pipe()
+		if err := in.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		replies := make(chan Message, 1)
+		go func() {
+			reply, _ := readMessage(in)
+			replies <- reply
+		}()
+		c := newClientHandler(out, "", nil, nil, nil)
+		c.id = 1
+		c.reg = &MessageRegister{
+			Client:     1,
+			Version:    ProtocolVersion,
+			Protocols:  []uint16{ProtocolTCP, ProtocolUDP},
+			Features:   ClientFeatures,
+			Interfaces: []*MessageInterface{{Name: "veth2"}},
+			Session:    session,
+		}
+		if got := s.acceptClient(c); got != want {
+			t.Errorf("got %t, want %t", got, want)
+		}
+		reply := (<-replies).(*MessageRegisterReply)
+		if reply.Accepted != want {
+			t.Errorf("got %v, want %t", reply, want)
+		}
+		if want && s.clients[1] != c {
+			t.Errorf("client not active")
+		}
+		return reply
+	}
+
+	// new client gets a session, returning client must use it
+	session := test("", true).Session
+	if session == "" {
+		t.Fatalf("got no session")
+	}
+	test("other", false)
+	if reply := test(session, true); reply.Session != session {
+		t.Errorf("got %s, want %s", reply.Session, session)
+	}
+
+	// restarted client without session gets a new session, the old
+	// session is invalid
+	restarted := test("", true).Session
+	if restarted == "" || restarted == session {
+		t.Errorf("got %q, want new session", restarted)
+	}
+	test(session, false)
+	test(restarted, true)
+}
+
+// TestClientHandlerTimeout tests timing out silent clients
+func TestClientHandlerTimeout(t *testing.T) {
+	in, out := net.Pipe()
+	go func() {
+		msg := &MessageRegister{Client: 1, Version: ProtocolVersion}
+		_ = writeMessage(in, msg)
+		_ = writeMessage(in, &MessageNop{})
+	}()
+	clientRegs := make(chan *clientHandler, 1)
+	clientLost := make(chan *clientHandler, 1)
+	c := newClientHandler(out, "", clientRegs, clientLost, nil)
+	c.timeout = 50 * time.Millisecond
+	go c.run()
+
+	select {
+	case lost := <-clientLost:
+		if lost != c {
+			t.Errorf("got %v, want %v", lost, c)
+		}
+		if lost.lastSeen.IsZero() {
+			t.Errorf("client never seen")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client did not time out")
+	}
+}
+
+// TestHandleResultRun tests ignoring late results of other plan runs
+func TestHandleResultRun(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1025"
+	p := newPlan(config)
+	r := &planRun{id: 2, plan: p, clients: p.getClients()}
+	p.setRun(uint32(r.id))
+	s := &server{active: []*planRun{r}}
+
+	for _, run := range []uint32{1, 3, 2} {
+		s.handleResult(&clientResult{
+			clientID: config.ReceiverID,
+			result: &MessageResult{
+				ID:     0,
+				Result: ResultPass,
+				Role:   RoleReceiver,
+				Run:    run,
+			},
+		})
+	}
+	if n := len(p.items[0].ReceiverResults); n != 1 {
+		t.Errorf("got %d results, want 1", n)
+	}
+}
+
+// TestStartQueueResume tests resuming queues while they move on to their
+// next plan item
+func TestStartQueueResume(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1026"
+	p := newPlan(config)
+	p.handleClient(config.SenderID)
+	p.handleClient(config.ReceiverID)
+	r := &planRun{id: 1, plan: p, clients: p.getClients()}
+	s := &server{active: []*planRun{r}, next: make(chan *queueNext, 1)}
+	q := p.queues[0]
+
+	// clients return after the sender test was sent; the item is not
+	// restarted and the queue moves on
+	s.startQueue(p, q)
+	s.sendSenderTest(p.items[0])
+	s.startQueue(p, q)
+	if p.items[0].SendTime.IsZero() {
+		t.Errorf("sent item was restarted")
+	}
+	s.handleNext(<-s.next)
+	if item := q.getCurrentItem(); item != p.items[1] {
+		t.Errorf("got item %v, want item 1", item)
+	}
+
+	// moving on after the current item was restarted is ignored
+	s.sendSenderTest(p.items[1])
+	q.restartCurrentItem()
+	s.handleNext(<-s.next)
+	if item := q.getCurrentItem(); item != p.items[1] {
+		t.Errorf("got item %v, want item 1", item)
+	}
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+)
+
+// getTLSCertPool reads the ca certificates in file into a certificate pool
+func getTLSCertPool(file string) *x509.CertPool {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatal("no valid ca certificates in file ", file)
+	}
+	return pool
+}
+
+// newServerTLSConfig creates the tls config of the server from the
+// certificate, key and ca files in config; if config contains a ca file,
+// clients must authenticate with a certificate signed by the ca. It returns
+// nil if tls is not configured
+func newServerTLSConfig(config *Config) *tls.Config {
+	if config.TLSCert == "" && config.TLSKey == "" && config.TLSCA == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	if config.TLSCA != "" {
+		tlsConfig.ClientCAs = getTLSCertPool(config.TLSCA)
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
+// newClientTLSConfig creates the tls config of the client from the
+// certificate, key and ca files in config; the server must authenticate with
+// a certificate signed by the ca. It returns nil if tls is not configured
+func newClientTLSConfig(config *Config) *tls.Config {
+	if config.TLSCert == "" && config.TLSKey == "" && config.TLSCA == "" {
+		return nil
+	}
+	if config.TLSCA == "" {
+		log.Fatal("tls requires a ca file to verify the server")
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    getTLSCertPool(config.TLSCA),
+		MinVersion: tls.VersionTLS13,
+	}
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig
+}
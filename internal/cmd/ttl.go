@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isTimeExceeded checks if result is an icmp time exceeded result caused by
+// the ttl or hop limit of the test packet
+func isTimeExceeded(result uint8) bool {
+	return result == ResultICMPv4TTLExceeded ||
+		result == ResultICMPv6HopLimitExceeded
+}
+
+// isSweepProbe checks if plan item is a probe of a ttl sweep that is followed
+// by another probe with a higher ttl, i.e., it is not the last probe of the
+// sweep
+func (p *plan) isSweepProbe(item *planItem) bool {
+	if item.SenderMsg.TTL == 0 {
+		return false
+	}
+	next := p.items[item.ID+1]
+	return next != nil && next.SenderMsg.TTL > item.SenderMsg.TTL &&
+		next.Port == item.Port && next.getFlow() == item.getFlow()
+}
+
+// getResultItems returns the plan items in the order of their ids; of ttl
+// sweeps, only the last probe is included
+func (p *plan) getResultItems() []*planItem {
+	items := []*planItem{}
+	for i := uint32(0); p.items[i] != nil; i++ {
+		if !p.isSweepProbe(p.items[i]) {
+			items = append(items, p.items[i])
+		}
+	}
+	return items
+}
+
+// ttlHop is the response to a probe of a ttl sweep
+type ttlHop struct {
+	ttl      uint8
+	response string
+}
+
+// ttlSweep contains the responses to all probes of a ttl sweep
+type ttlSweep struct {
+	hops     []*ttlHop
+	summary  string
+	lastHop  uint8
+	lastFrom string
+}
+
+// addHop adds the response to the probe with ttl to the sweep; consecutive
+// probes without response are merged
+func (t *ttlSweep) addHop(ttl uint8, response string) {
+	if length := len(t.hops); length > 0 && response == "*" &&
+		t.hops[length-1].response == "*" {
+		t.hops[length-1].ttl = ttl
+		return
+	}
+	t.hops = append(t.hops, &ttlHop{ttl, response})
+}
+
+// String converts the ttl sweep to a string, e.g.,
+// "1: 10.0.1.254, 2: 10.0.2.254, 3-30: *; no responses after hop 2"
+func (t *ttlSweep) String() string {
+	hops := []string{}
+	first := uint8(1)
+	for _, h := range t.hops {
+		ttl := fmt.Sprintf("%d", h.ttl)
+		if first != h.ttl {
+			ttl = fmt.Sprintf("%d-%d", first, h.ttl)
+		}
+		hops = append(hops, fmt.Sprintf("%s: %s", ttl, h.response))
+		first = h.ttl + 1
+	}
+	return fmt.Sprintf("%s; %s", strings.Join(hops, ", "), t.summary)
+}
+
+// addProbe adds the response to the probe in plan item to the sweep; it
+// returns false if the sweep ended because the probe reached the receiver or
+// was rejected
+func (t *ttlSweep) addProbe(item *planItem) bool {
+	ttl := item.SenderMsg.TTL
+	if item.containsPass() {
+		t.addHop(ttl, "receiver")
+		t.summary = fmt.Sprintf("reached receiver at hop %d", ttl)
+		return false
+	}
+	for _, r := range item.SenderResults {
+		if !isReject(r.Result) && !isPathError(r.Result) {
+			continue
+		}
+		from := "?"
+		if source := item.getRejectSource(r); source != nil {
+			from = source.ip.String()
+		}
+		if isTimeExceeded(r.Result) {
+			t.addHop(ttl, from)
+			t.lastHop = ttl
+			t.lastFrom = from
+			return true
+		}
+		t.addHop(ttl, fmt.Sprintf("%s (%s)", from,
+			resultString(r.Result)))
+		t.summary = fmt.Sprintf("rejected at hop %d by %s (%s)", ttl,
+			from, resultString(r.Result))
+		return false
+	}
+	t.addHop(ttl, "*")
+	return true
+}
+
+// finish sets the summary of the sweep if it did not end early
+func (t *ttlSweep) finish() {
+	switch {
+	case t.summary != "":
+	case t.lastHop == 0:
+		t.summary = "no responses"
+	default:
+		t.summary = fmt.Sprintf("no responses after hop %d (%s)",
+			t.lastHop, t.lastFrom)
+	}
+}
+
+// getTTLResults returns the path and the hop where the probes stop producing
+// responses or start producing rejects of all ttl sweeps in the plan
+func (p *plan) getTTLResults() *planHopResults {
+	results := &planHopResults{}
+	sweep := &ttlSweep{}
+	done := false
+	for i := uint32(0); p.items[i] != nil; i++ {
+		item := p.items[i]
+		if item.SenderMsg.TTL == 0 || item.isFirewalk() {
+			continue
+		}
+		if !done {
+			done = !sweep.addProbe(item)
+		}
+		if p.isSweepProbe(item) {
+			continue
+		}
+		sweep.finish()
+		results.add(item.getFlow(), item.Port, sweep.String())
+		sweep = &ttlSweep{}
+		done = false
+	}
+	return results
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// Example_printResults_ttl runs printResults() with ttl sweeps that reach the
+// receiver, are rejected and stop producing responses
+func Example_printResults_ttl() {
+	// init
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+	config := NewConfig()
+	config.PortRange = "1024:1026"
+	config.Protocol = ProtocolUDP
+	config.SenderSrcMAC = "02:00:00:00:00:02"
+	config.SenderDstMAC = "02:00:00:00:00:01"
+	config.SenderSrcIP = "10.0.1.1"
+	config.SenderDstIP = "10.0.2.2"
+	config.Mode = ModeTTL
+	config.MaxTTL = 5
+	plan := newPlan(config)
+
+	// set result of probe with id from router ip
+	icmp := func(id uint32, ip string, result uint8,
+		typeCode layers.ICMPv4TypeCode) {
+		item := plan.items[id]
+		item.SenderResults = []*MessageResult{{
+			Result: result,
+			Packet: getExampleRejectPacket(
+				&layers.Ethernet{
+					SrcMAC:       item.SenderMsg.DstMAC,
+					DstMAC:       item.SenderMsg.SrcMAC,
+					EthernetType: layers.EthernetTypeIPv4,
+				},
+				&layers.IPv4{
+					Version:  4,
+					TTL:      64,
+					Protocol: layers.IPProtocolICMPv4,
+					SrcIP:    net.ParseIP(ip),
+					DstIP:    item.SenderMsg.SrcIP,
+				},
+				&layers.ICMPv4{TypeCode: typeCode},
+				gopacket.Payload(newSenderPacket(
+					item.SenderMsg).bytes()[14:]),
+			),
+		}}
+	}
+	exceeded := layers.CreateICMPv4TypeCode(
+		layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded)
+	prohibited := layers.CreateICMPv4TypeCode(
+		layers.ICMPv4TypeDestinationUnreachable,
+		layers.ICMPv4CodeCommAdminProhibited)
+
+	// port 1024 reaches the receiver
+	icmp(0, "10.0.1.254", ResultICMPv4TTLExceeded, exceeded)
+	icmp(1, "10.0.3.254", ResultICMPv4TTLExceeded, exceeded)
+	for id := uint32(2); id < 5; id++ {
+		plan.items[id].ReceiverResults = []*MessageResult{
+			{Result: ResultPass},
+		}
+	}
+
+	// port 1025 is rejected at the second hop
+	icmp(5, "10.0.1.254", ResultICMPv4TTLExceeded, exceeded)
+	for id := uint32(6); id < 10; id++ {
+		icmp(id, "10.0.3.254", ResultICMPv4CommProhibited, prohibited)
+	}
+
+	// port 1026 is dropped after the second hop
+	icmp(10, "10.0.1.254", ResultICMPv4TTLExceeded, exceeded)
+	icmp(11, "10.0.3.254", ResultICMPv4TTLExceeded, exceeded)
+
+	// check output
+	plan.printResults()
+
+	// Output:
+	// Printing results:
+	// 1024	pass
+	// 1025	reject: icmpv4-comm-prohibited
+	// 1026	drop
+	// Printing reject sources:
+	// udp 10.0.1.1 -> 10.0.2.2
+	// 1025	icmpv4-comm-prohibited from middlebox 10.0.3.254 (mac 02:00:00:00:00:01, ttl 64, distance 0), quoted ttl 5
+	// Printing ttl sweep results:
+	// udp 10.0.1.1 -> 10.0.2.2
+	// 1024	1: 10.0.1.254, 2: 10.0.3.254, 3: receiver; reached receiver at hop 3
+	// 1025	1: 10.0.1.254, 2: 10.0.3.254 (icmpv4-comm-prohibited); rejected at hop 2 by 10.0.3.254 (icmpv4-comm-prohibited)
+	// 1026	1: 10.0.1.254, 2: 10.0.3.254, 3-5: *; no responses after hop 2 (10.0.3.254)
+}
+
+// TestFirewalkPlan tests creating a firewalk plan without receiver
+func TestFirewalkPlan(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1026"
+	config.Mode = ModeFirewalk
+	config.GatewayHops = 2
+	p := newPlan(config)
+	if err := p.check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range p.items {
+		if item.ReceiverMsg != nil || item.ReceiverID != 0 ||
+			item.SenderMsg.TTL != 3 || !item.isFirewalk() {
+			t.Errorf("got item %v, want firewalk probe", item)
+		}
+	}
+	if got := p.getClients(); !slices.Equal(got, []uint8{1}) {
+		t.Errorf("got clients %v, want [1]", got)
+	}
+	p.handleClient(1)
+	if !p.clientsActive() {
+		t.Errorf("clients not active")
+	}
+
+	// items without receiver test must be firewalk probes
+	p.items[0].SenderMsg.TTL = 0
+	if err := p.check(); err == nil {
+		t.Errorf("got no error for item without receiver test")
+	}
+}
+
+// Example_printResults_firewalk runs printResults() with firewalk probes
+// that expire behind the middlebox, are rejected or dropped by it
+func Example_printResults_firewalk() {
+	// init
+	plan := getExamplePrintResultsPlan("1024:1029")
+	for _, item := range plan.items {
+		item.ReceiverMsg = nil
+		item.SenderMsg.TTL = 2
+	}
+
+	// set results
+	for id := uint32(0); id < 3; id++ {
+		plan.items[id].SenderResults = []*MessageResult{
+			{Result: ResultICMPv4TTLExceeded},
+		}
+	}
+	plan.items[3].SenderResults = []*MessageResult{
+		{Result: ResultICMPv4CommProhibited},
+	}
+
+	// check output
+	plan.printResults()
+
+	// Output:
+	// Printing results:
+	// 1024:1026	pass
+	// 1027	reject: icmpv4-comm-prohibited
+	// 1028:1029	drop
+}
+
+// TestTTLResultItems tests that only the last probes of ttl sweeps are
+// counted in the zone matrix, the csv output and the diff of results
+func TestTTLResultItems(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1025"
+	config.Mode = ModeTTL
+	config.MaxTTL = 3
+	plan := newPlan(config)
+	for _, item := range plan.items {
+		item.PacketDiffs.add("TTL", "0", "1")
+		item.Hops = []*planHop{{
+			ReceiverID:      3,
+			ReceiverMsg:     &MessageTest{},
+			ReceiverResults: []*MessageResult{{Result: ResultPass}},
+		}}
+		switch item.SenderMsg.TTL {
+		case config.MaxTTL:
+			item.ReceiverResults = []*MessageResult{
+				{Result: ResultPass},
+			}
+		default:
+			item.SenderResults = []*MessageResult{
+				{Result: ResultICMPv4TTLExceeded},
+			}
+		}
+	}
+
+	if n := len(plan.getResultItems()); n != 2 {
+		t.Errorf("got %d result items, want 2", n)
+	}
+	if got := plan.getZoneMatrix(); !strings.Contains(got, "pass=2") ||
+		strings.Contains(got, "reject") {
+		t.Errorf("got zone matrix %q, want pass=2", got)
+	}
+	var csv bytes.Buffer
+	if err := resultWriters["csv"].write(&csv, plan); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(csv.String(), "\n"); n != 3 {
+		t.Errorf("got %d csv lines, want 3", n)
+	}
+	if diffs := newPlanDiff(plan, plan).getResults(); len(diffs.ranges) > 0 {
+		t.Errorf("got diffs %s, want none", diffs)
+	}
+	var json bytes.Buffer
+	if err := resultWriters["json"].write(&json, plan); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(json.String(), `"field":"TTL"`); n != 2 {
+		t.Errorf("got %d json packet diffs, want 2", n)
+	}
+	if hops := plan.getHopResults(); len(hops.ranges) != 1 {
+		t.Errorf("got hop results %s, want one range", hops)
+	}
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TUIInterval is the interval between updates of the terminal ui
+	TUIInterval = time.Second
+
+	// TUILogLines is the number of log lines shown in the terminal ui
+	TUILogLines = 5
+
+	// TUIResultLines is the maximum number of result lines shown for each
+	// plan in the terminal ui
+	TUIResultLines = 20
+)
+
+// tui is a terminal user interface that shows the connected clients and the
+// progress and results of the running plans of the server; screen is the
+// last rendered screen without the log
+type tui struct {
+	sync.Mutex
+	out    io.Writer
+	logs   []string
+	screen string
+}
+
+// Write stores the log lines in p for showing them in the terminal ui; once
+// the terminal ui is shown, they are shown right away, so also the last log
+// lines before the server exits, e.g., fatal errors, are shown
+func (t *tui) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	lines := strings.Split(strings.TrimSuffix(string(p), "\n"), "\n")
+	t.logs = append(t.logs, lines...)
+	if len(t.logs) > TUILogLines {
+		t.logs = t.logs[len(t.logs)-TUILogLines:]
+	}
+	if t.screen != "" {
+		t.draw()
+	}
+	return len(p), nil
+}
+
+// draw writes the last rendered screen and the log to the terminal; the
+// caller must hold the lock
+func (t *tui) draw() {
+	b := &strings.Builder{}
+	b.WriteString(t.screen)
+	b.WriteString("\nLog:\n")
+	for _, line := range t.logs {
+		fmt.Fprintf(b, "  %s\n", line)
+	}
+	_, _ = io.WriteString(t.out, b.String())
+}
+
+// getETA returns the estimated remaining time of plan run r
+func getETA(r *planRun, elapsed time.Duration) string {
+	done := r.plan.getProgress()
+	if done == 0 {
+		return "unknown"
+	}
+	remaining := len(r.plan.items) - done
+	eta := elapsed / time.Duration(done) * time.Duration(remaining)
+	return eta.Round(time.Second).String()
+}
+
+// renderRun writes the progress and results of plan run r to b
+func (t *tui) renderRun(b *strings.Builder, r *planRun) {
+	done := r.plan.getProgress()
+	numItems := len(r.plan.items)
+	elapsed := time.Since(r.started)
+	fmt.Fprintf(b, "\nPlan %d (%s): %d/%d items (%.0f%%), %.1f items/s, "+
+		"elapsed %s, ETA %s\n", r.id, r.state, done, numItems,
+		float64(done)/float64(numItems)*100,
+		float64(done)/elapsed.Seconds(),
+		elapsed.Round(time.Second), getETA(r, elapsed))
+
+	// current items
+	for _, q := range r.plan.queues {
+		if item := q.getCurrentItem(); item != nil {
+			fmt.Fprintf(b, "  sender %d -> receiver %d: item %d, "+
+				"port %d\n", q.senderID, q.receiverID, item.ID,
+				item.Port)
+		}
+	}
+
+	// results of completed items
+	results := r.plan.getCompletedResults().String()
+	if results == "" {
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(results, "\n"), "\n")
+	if len(lines) > TUIResultLines {
+		b.WriteString("  ...\n")
+		lines = lines[len(lines)-TUIResultLines:]
+	}
+	for _, line := range lines {
+		fmt.Fprintf(b, "  %s\n", line)
+	}
+}
+
+// render shows the state of server s in the terminal ui
+func (t *tui) render(s *server) {
+	b := &strings.Builder{}
+
+	// clear screen and move cursor to top left corner
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(b, "middleboxer server, %s\n",
+		time.Now().Format(time.DateTime))
+
+	// connected clients
+	fmt.Fprintf(b, "\nClients: %d\n", len(s.clients))
+	for _, id := range slices.Sorted(maps.Keys(s.clients)) {
+		c := s.clients[id]
+		fmt.Fprintf(b, "  %d: %s (software version %s)\n", id,
+			c.conn.RemoteAddr(), c.reg.Software)
+	}
+
+	// running plans
+	if len(s.active) == 0 {
+		b.WriteString("\nNo running plans\n")
+	}
+	for _, r := range s.active {
+		t.renderRun(b, r)
+	}
+
+	// log
+	t.Lock()
+	t.screen = b.String()
+	t.draw()
+	t.Unlock()
+}
+
+// newTUI creates a new terminal ui that writes to out
+func newTUI(out io.Writer) *tui {
+	return &tui{
+		out: out,
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTUIRender tests rendering the progress of a plan in the terminal ui
+func TestTUIRender(t *testing.T) {
+	config := NewConfig()
+	config.PortRange = "1024:1032"
+	config.SenderDevice = "veth2"
+	config.ReceiverDevice = "veth4"
+	p := newPlan(config)
+	p.queues[0].current = 3
+	s := &server{
+		clients: make(map[uint8]*clientHandler),
+		active: []*planRun{{
+			id:      1,
+			plan:    p,
+			state:   RunStateRunning,
+			started: time.Now().Add(-3 * time.Second),
+		}},
+	}
+
+	var out bytes.Buffer
+	ui := newTUI(&out)
+	logger := log.New(ui, "", 0)
+	for i := 0; i < TUILogLines+1; i++ {
+		logger.Printf("line %d", i)
+	}
+	ui.render(s)
+
+	got := out.String()
+	for _, want := range []string{
+		"Clients: 0\n",
+		"Plan 1 (running): 3/9 items (33%), 1.0 items/s, elapsed 3s, " +
+			"ETA 6s\n",
+		"sender 1 -> receiver 2: item 3, port 1027\n",
+		"1024:1026\tdrop\n",
+		"Log:\n  line 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if strings.Contains(got, "line 0\n") {
+		t.Errorf("got %q, want last %d log lines", got, TUILogLines)
+	}
+}
+
+// TestTUIWrite tests showing log lines in the terminal ui right away
+func TestTUIWrite(t *testing.T) {
+	s := &server{clients: make(map[uint8]*clientHandler)}
+	var out bytes.Buffer
+	ui := newTUI(&out)
+	ui.render(s)
+	out.Reset()
+
+	log.New(ui, "", 0).Print("fatal error")
+	got := out.String()
+	if !strings.HasPrefix(got, "\033[H\033[2J") ||
+		!strings.HasSuffix(got, "Log:\n  fatal error\n") {
+		t.Errorf("got %q, want screen with log line", got)
+	}
+}